@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"SimpleNosrtRelay/infra/admin"
+	"SimpleNosrtRelay/infra/community"
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"SimpleNosrtRelay/infra/report"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Manage invites, bans and roles",
+	Long: `Manage invites, bans and role grants without publishing kind 35000 events.
+Operates directly on the database when the server is stopped, or calls the running
+server's management API (signed with --key or NRS_ADMIN_KEY) when it is up.
+Pubkeys may be given as hex, npub, nprofile or NIP-05 addresses.`,
+}
+
+func init() {
+	rootCmd.AddCommand(adminCmd)
+	adminCmd.PersistentFlags().Bool("remote", false, "Always use the running server's management API")
+	adminCmd.PersistentFlags().String("url", "", "Management API URL (defaults to info.url)")
+	adminCmd.PersistentFlags().String("key", "", "Secret key (hex or nsec) used to sign management API calls")
+
+	adminCmd.AddCommand(
+		newAdminCommand("invite <pubkey> [name]", "Invite a pubkey", cobra.RangeArgs(1, 2), "allowpubkey"),
+		newAdminCommand("ban <pubkey> [reason]", "Ban a pubkey and remove its invite", cobra.MinimumNArgs(1), "banpubkey"),
+		newAdminCommand("unban <pubkey>", "Lift a ban", cobra.ExactArgs(1), "unbanpubkey"),
+		newAdminCommand("grant <pubkey> <role>", "Grant a role to a pubkey", cobra.ExactArgs(2), "grantrole"),
+		newAdminCommand("revoke <pubkey> <role>", "Revoke a role from a pubkey", cobra.ExactArgs(2), "revokerole"),
+		newAdminCommand("list-invited", "List invited pubkeys", cobra.NoArgs, "listallowedpubkeys"),
+		newAdminCommand("list-banned", "List banned pubkeys", cobra.NoArgs, "listbannedpubkeys"),
+		newAdminCommand("show <pubkey>", "Show everything known about a pubkey", cobra.ExactArgs(1), "showpubkey"),
+		newAdminCommand("claim-name <pubkey> <name>", "Assign a NIP-05 name to a pubkey", cobra.ExactArgs(2), "claimname"),
+		newAdminCommand("release-name <pubkey>", "Release the NIP-05 name of a pubkey", cobra.ExactArgs(1), "releasename"),
+		newAdminCommand("list-names", "List claimed NIP-05 names", cobra.NoArgs, "listnames"),
+		newAdminCommand("list-pending <community>", "List posts awaiting approval in a NIP-72 community (34550:<pubkey>:<d>)", cobra.ExactArgs(1), "listpendingposts"),
+		newAdminCommand("reports", "List reported events and pubkeys, most reported first", cobra.NoArgs, "listreports"),
+		newAdminCommand("resolve-report <event id or pubkey> <dismiss|hide|delete|ban>", "Act on the reports about an event or pubkey", cobra.ExactArgs(2), "resolvereport"),
+		newAdminCommand("list-private-kinds", "List the kinds only served to their participants", cobra.NoArgs, "listprivatekinds"),
+		newAdminCommand("add-private-kind <kind>", "Serve a kind only to its author and p-tagged recipients", cobra.ExactArgs(1), "addprivatekind"),
+		newAdminCommand("remove-private-kind <kind>", "Serve a kind to everyone again", cobra.ExactArgs(1), "removeprivatekind"),
+	)
+}
+
+// newAdminCommand builds a subcommand that calls the management method with its arguments.
+// Arguments after the second are joined into the last parameter, so reasons need no quoting.
+func newAdminCommand(use, short string, args cobra.PositionalArgs, method string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  args,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := config.InitConfig(); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to initialize configuration:", err)
+				os.Exit(1)
+			}
+			log.Init()
+
+			params := make([]any, 0, 2)
+			if len(args) > 0 {
+				params = append(params, args[0])
+			}
+			if len(args) > 1 {
+				params = append(params, strings.Join(args[1:], " "))
+			}
+
+			result, err := runAdmin(cmd, method, params)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			printJSON(result)
+		},
+	}
+}
+
+// runAdmin calls method locally on the database, falling back to the management API
+// when the database is locked by a running server or --remote is set.
+func runAdmin(cmd *cobra.Command, method string, params []any) (any, error) {
+	if remote, _ := cmd.Flags().GetBool("remote"); !remote {
+		result, err := runAdminLocal(method, params)
+		if !errors.Is(err, errDatabaseLocked) {
+			return result, err
+		}
+		log.Logger.Debug("Database is locked, using the management API")
+	}
+	return runAdminRemote(cmd, method, params)
+}
+
+var errDatabaseLocked = errors.New("database is locked by another process")
+
+func runAdminLocal(method string, params []any) (any, error) {
+	baseDir, err := getAbsBaseDir()
+	if err != nil {
+		return nil, err
+	}
+	store, err := initBadgerStore(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Init(); err != nil {
+		if strings.Contains(err.Error(), "Cannot acquire directory lock") {
+			return nil, errDatabaseLocked
+		}
+		return nil, fmt.Errorf("failed to initialize event store: %w", err)
+	}
+	defer store.Close()
+	// the server is not running, so the search index is free too; deleted events leave it
+	search, err := initBlugeSearch(baseDir, store)
+	if err != nil {
+		return nil, err
+	}
+	defer search.Close()
+
+	m := manager.NewManager(store.DB)
+	if _, err := m.MigrateResources(); err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy resources: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	api := admin.NewAPI(m)
+	api.Communities = community.New(store.DB, store)
+	api.Reports = report.NewQueue(store.DB, store, m)
+	api.Reports.DeleteEvent = append(api.Reports.DeleteEvent, store.DeleteEvent, search.DeleteEvent)
+	return api.Dispatch(ctx, method, params)
+}
+
+func runAdminRemote(cmd *cobra.Command, method string, params []any) (any, error) {
+	url, _ := cmd.Flags().GetString("url")
+	if url == "" {
+		url = config.Cfg.Info.Url
+	}
+	key, _ := cmd.Flags().GetString("key")
+	if key == "" {
+		key = os.Getenv("NRS_ADMIN_KEY")
+	}
+
+	client, err := admin.NewClient(url, key)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	return client.Call(ctx, method, params...)
+}
+
+func printJSON(v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Logger.Error("Failed to marshal result", zap.Error(err))
+		return
+	}
+	fmt.Println(string(out))
+}
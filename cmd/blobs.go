@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"SimpleNosrtRelay/infra/blob"
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"SimpleNosrtRelay/infra/vanish"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var blobsCmd = &cobra.Command{
+	Use:   "blobs",
+	Short: "Manage Blossom blob storage",
+}
+
+var blobsGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Delete unowned and orphaned blobs",
+	Long: `Delete blobs with no remaining owners, blobs whose uploaders were all banned or vanished,
+files in blobs/ without an index entry and index entries whose file is missing.
+With --dry-run nothing is deleted and the report shows the reclaimable bytes.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := config.InitConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to initialize configuration:", err)
+			os.Exit(1)
+		}
+		log.Init()
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		baseDir, err := getAbsBaseDir()
+		if err != nil {
+			log.Logger.Fatal("Failed to get absolute path", zap.Error(err))
+		}
+		store, err := initBadgerStore(baseDir)
+		if err != nil {
+			log.Logger.Fatal("Failed to initialize Badger store", zap.Error(err))
+		}
+		if err := store.Init(); err != nil {
+			log.Logger.Fatal("Failed to initialize event store", zap.Error(err))
+		}
+		defer store.Close()
+
+		m := manager.NewManager(store.DB)
+		vanisher := vanish.New(store.DB, store, m)
+		blobConfig, err := newBlobConfig(baseDir, config.Cfg.Info.Url)
+		if err != nil {
+			log.Logger.Fatal("Failed to configure blob storage", zap.Error(err))
+		}
+		bs := blob.NewBlobStore(store.DB, blobConfig)
+		// blobs still in the flat layout would look missing from the index
+		if err := bs.Init(); err != nil {
+			log.Logger.Fatal("Failed to initialize the blob storage", zap.Error(err))
+		}
+
+		report, err := bs.GC(context.Background(), blobOwnerGone(m, vanisher), dryRun)
+		if err != nil {
+			log.Logger.Fatal("Failed to collect blobs", zap.Error(err))
+		}
+		printJSON(report)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(blobsCmd)
+	blobsCmd.AddCommand(blobsGCCmd)
+	blobsGCCmd.Flags().Bool("dry-run", false, "Report what would be deleted without deleting anything")
+}
+
+// newBlobConfig returns the configuration of the blob store, kept in baseDir/blobs or in
+// the backend selected by blossom.storage.
+func newBlobConfig(baseDir, serviceURL string) (*blob.Config, error) {
+	backend, err := newBlobBackend(filepath.Join(baseDir, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+	return &blob.Config{
+		BasePath:       filepath.Join(baseDir, "blobs"),
+		Backend:        backend,
+		ServiceURL:     serviceURL,
+		ExtAcceptable:  []string{".jpg", ".gif", ".png", ".webp", ".mp4", ".webm", ".ogg"},
+		MaxFileSize:    10 * 1024 * 1024, // 10MB
+		MimeAcceptable: []string{"image/png", "image/jpeg", "image/gif", "image/webp", "video/mp4", "video/webm", "video/ogg"},
+		AuthRequired:   config.Cfg.Blossom.AuthRequired,
+		Images: blob.ImageConfig{
+			StripMetadata:  config.Cfg.Blossom.Images.StripMetadata,
+			ThumbnailSizes: config.Cfg.Blossom.Images.ThumbnailSizes,
+		},
+		Retention: blob.RetentionConfig{
+			Longest: config.Cfg.Blossom.Retention.Longest(),
+			MaxIdle: config.Cfg.Blossom.Retention.MaxIdle,
+		},
+	}, nil
+}
+
+// newBlobBackend creates the backend selected by blossom.storage.backend.
+func newBlobBackend(basePath string) (blob.Backend, error) {
+	c := config.Cfg.Blossom.Storage
+	switch c.Backend {
+	case "", "local":
+		return blob.NewLocalBackend(basePath), nil
+	case "memory":
+		log.Logger.Warn("Blobs are kept in memory and will be lost on restart")
+		return blob.NewMemoryBackend(), nil
+	case "s3":
+		return blob.NewS3Backend(context.Background(), blob.S3Config{
+			Endpoint:  c.S3.Endpoint,
+			Region:    c.S3.Region,
+			Bucket:    c.S3.Bucket,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+			Prefix:    c.S3.Prefix,
+			Insecure:  c.S3.Insecure,
+		})
+	}
+	return nil, fmt.Errorf("unknown blob storage backend %q", c.Backend)
+}
+
+// blobOwnerGone reports the owners whose blobs no longer count as owned: banned or vanished pubkeys.
+func blobOwnerGone(m *manager.Manager, vanisher *vanish.Vanisher) func(pubkey string) bool {
+	return func(pubkey string) bool {
+		return m.IsBanned(pubkey) || vanisher.Vanished(pubkey)
+	}
+}
@@ -2,7 +2,12 @@ package cmd
 
 import (
 	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/expiration"
+	"SimpleNosrtRelay/infra/hll"
 	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"SimpleNosrtRelay/infra/tombstone"
+	"SimpleNosrtRelay/infra/vanish"
 	"bufio"
 	"context"
 	"encoding/json"
@@ -11,9 +16,11 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/fiatjaf/eventstore"
+	badgerstore "github.com/fiatjaf/eventstore/badger"
 	"github.com/fiatjaf/eventstore/bluge"
 	"github.com/fiatjaf/eventstore/mmm/betterbinary"
 	"github.com/nbd-wtf/go-nostr"
@@ -63,7 +70,15 @@ func runImport(cmd *cobra.Command, _ []string) {
 		search.Close()
 	}()
 
-	if err := importEventsFromFile(filename, fileType, store, search); err != nil {
+	imp := &importer{
+		store:       store,
+		search:      search,
+		tombstones:  tombstone.NewStore(store.DB),
+		vanisher:    vanish.New(store.DB, store, manager.NewManager(store.DB)),
+		expirations: expiration.NewIndex(store.DB, store),
+		counts:      hll.NewStore(store.DB, store),
+	}
+	if err := imp.importEventsFromFile(filename, fileType); err != nil {
 		log.Logger.Fatal("Failed to import events", zap.Error(err))
 	}
 }
@@ -76,7 +91,7 @@ func getAbsBaseDir() (string, error) {
 	return filepath.Abs(baseDir)
 }
 
-func initDataStores(baseDir string) (eventstore.Store, *bluge.BlugeBackend, error) {
+func initDataStores(baseDir string) (*badgerstore.BadgerBackend, *bluge.BlugeBackend, error) {
 	store, err := initBadgerStore(baseDir)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to initialize Badger store: %w", err)
@@ -93,6 +108,18 @@ func initDataStores(baseDir string) (eventstore.Store, *bluge.BlugeBackend, erro
 	return store, search, nil
 }
 
+// importer writes imported events to the event store and search index, keeping
+// tombstones, the expiration index and the count registers in step. Events signed by
+// vanished pubkeys before their request are skipped, as the relay would refuse them.
+type importer struct {
+	store       eventstore.Store
+	search      *bluge.BlugeBackend
+	tombstones  *tombstone.Store
+	vanisher    *vanish.Vanisher
+	expirations *expiration.Index
+	counts      *hll.Store
+}
+
 func validateFileType(filename string) (string, error) {
 	if len(filename) < 5 {
 		return "", fmt.Errorf("invalid file type: %s", filename)
@@ -120,7 +147,7 @@ func initBlugeSearch(baseDir string, store eventstore.Store) (*bluge.BlugeBacken
 	return &search, nil
 }
 
-func importEventsFromFile(filename, fileType string, store eventstore.Store, search *bluge.BlugeBackend) error {
+func (imp *importer) importEventsFromFile(filename, fileType string) error {
 	file, err := os.Open(filename)
 	if err != nil {
 		return fmt.Errorf("failed to open file %s: %w", filename, err)
@@ -135,12 +162,12 @@ func importEventsFromFile(filename, fileType string, store eventstore.Store, sea
 	counter := 0
 
 	if fileType == "jsonl" {
-		counter, err = importFromJSONL(reader, store, search)
+		counter, err = imp.importFromJSONL(reader)
 		if err != nil {
 			return err
 		}
 	} else if fileType == "json" {
-		counter, err = importFromJSON(reader, store, search)
+		counter, err = imp.importFromJSON(reader)
 		if err != nil {
 			return err
 		}
@@ -150,7 +177,7 @@ func importEventsFromFile(filename, fileType string, store eventstore.Store, sea
 	return nil
 }
 
-func importFromJSONL(reader *bufio.Reader, store eventstore.Store, search *bluge.BlugeBackend) (int, error) {
+func (imp *importer) importFromJSONL(reader *bufio.Reader) (int, error) {
 	counter := 0
 	for {
 		line, err := readLine(reader)
@@ -173,11 +200,11 @@ func importFromJSONL(reader *bufio.Reader, store eventstore.Store, search *bluge
 			continue
 		}
 
-		if !isValidEvent(event) {
+		if !isValidEvent(event) || imp.vanished(context.Background(), event) || !imp.applyTombstones(context.Background(), event) {
 			continue
 		}
 
-		if err := saveEvent(context.Background(), store, search, event); err != nil {
+		if err := imp.saveEvent(context.Background(), event); err != nil {
 			if errors.Is(err, eventstore.ErrDupEvent) {
 				continue
 			}
@@ -189,7 +216,7 @@ func importFromJSONL(reader *bufio.Reader, store eventstore.Store, search *bluge
 	return counter, nil
 }
 
-func importFromJSON(reader *bufio.Reader, store eventstore.Store, search *bluge.BlugeBackend) (int, error) {
+func (imp *importer) importFromJSON(reader *bufio.Reader) (int, error) {
 	data, _ := reader.ReadBytes('\n')
 	var events []nostr.Event
 	if err := json.Unmarshal(data, &events); err != nil {
@@ -197,11 +224,11 @@ func importFromJSON(reader *bufio.Reader, store eventstore.Store, search *bluge.
 	}
 	counter := 0
 	for _, event := range events {
-		if !isValidEvent(&event) {
+		if !isValidEvent(&event) || imp.vanished(context.Background(), &event) || !imp.applyTombstones(context.Background(), &event) {
 			continue
 		}
 
-		if err := saveEvent(context.Background(), store, search, &event); err != nil {
+		if err := imp.saveEvent(context.Background(), &event); err != nil {
 			if errors.Is(err, eventstore.ErrDupEvent) {
 				continue
 			}
@@ -223,6 +250,76 @@ func isValidEvent(event *nostr.Event) bool {
 		log.Logger.Debug("Invalid signature", zap.Error(err))
 		return false
 	}
+
+	if expiration.IsExpired(event) {
+		log.Logger.Debug("Skipping expired event", zap.String("ID", event.ID))
+		return false
+	}
+	return true
+}
+
+// vanished reports whether the relay refuses event because of a request to vanish: it was
+// signed by a vanished pubkey before its request, or is a request aimed at other relays.
+func (imp *importer) vanished(ctx context.Context, event *nostr.Event) bool {
+	if reject, msg := imp.vanisher.RejectEvent(ctx, event); reject {
+		log.Logger.Debug("Skipping event", zap.String("ID", event.ID), zap.String("reason", msg))
+		return true
+	}
+	return false
+}
+
+// applyTombstones reports whether event may be imported. Deletions (kind 5) are recorded as
+// tombstones and remove the matching events already imported; events matching a tombstone are skipped.
+func (imp *importer) applyTombstones(ctx context.Context, event *nostr.Event) bool {
+	if imp.tombstones.IsDeleted(event) {
+		log.Logger.Debug("Skipping deleted event", zap.String("ID", event.ID))
+		return false
+	}
+	if event.Kind != nostr.KindDeletion {
+		return true
+	}
+
+	if err := imp.tombstones.RecordDeletion(event); err != nil {
+		log.Logger.Error("Failed to record tombstone", zap.Error(err), zap.String("ID", event.ID))
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		var filter nostr.Filter
+		switch tag[0] {
+		case "e":
+			filter = nostr.Filter{IDs: []string{tag[1]}, Authors: []string{event.PubKey}}
+		case "a":
+			spl := strings.SplitN(tag[1], ":", 3)
+			if len(spl) != 3 || spl[1] != event.PubKey {
+				continue
+			}
+			kind, err := strconv.Atoi(spl[0])
+			if err != nil {
+				continue
+			}
+			until := event.CreatedAt
+			filter = nostr.Filter{Kinds: []int{kind}, Authors: []string{event.PubKey}, Until: &until}
+			if nostr.IsAddressableKind(kind) {
+				filter.Tags = nostr.TagMap{"d": []string{spl[2]}}
+			}
+		default:
+			continue
+		}
+		ch, err := imp.store.QueryEvents(ctx, filter)
+		if err != nil {
+			continue
+		}
+		for target := range ch {
+			if err := imp.store.DeleteEvent(ctx, target); err != nil {
+				log.Logger.Error("Failed to delete event", zap.Error(err), zap.String("ID", target.ID))
+			}
+			if err := imp.search.DeleteEvent(ctx, target); err != nil {
+				log.Logger.Error("Failed to delete event from search index", zap.Error(err), zap.String("ID", target.ID))
+			}
+		}
+	}
 	return true
 }
 
@@ -239,12 +336,18 @@ func unmarshalEvent(line []byte) (*nostr.Event, error) {
 	return &event, nil
 }
 
-func saveEvent(ctx context.Context, store eventstore.Store, search *bluge.BlugeBackend, event *nostr.Event) error {
-	if err := store.SaveEvent(ctx, event); err != nil {
+func (imp *importer) saveEvent(ctx context.Context, event *nostr.Event) error {
+	if err := imp.store.SaveEvent(ctx, event); err != nil {
 		return fmt.Errorf("failed to save event to event store: %w", err)
 	}
-	if err := search.SaveEvent(ctx, event); err != nil {
+	if err := imp.search.SaveEvent(ctx, event); err != nil {
 		return fmt.Errorf("failed to save event to search index: %w", err)
 	}
+	if err := imp.expirations.SaveEvent(ctx, event); err != nil {
+		return fmt.Errorf("failed to index event expiration: %w", err)
+	}
+	if err := imp.counts.SaveEvent(ctx, event); err != nil {
+		return fmt.Errorf("failed to count event: %w", err)
+	}
 	return nil
 }
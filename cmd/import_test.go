@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/expiration"
+	"SimpleNosrtRelay/infra/hll"
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"SimpleNosrtRelay/infra/tombstone"
+	"SimpleNosrtRelay/infra/vanish"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+const testSecretKey = "000000000000000000000000000000000000000000000000000000000000000a"
+
+func newTestImporter(t *testing.T) *importer {
+	t.Helper()
+	log.Logger = zap.NewNop()
+	config.Cfg = &config.Config{Info: &config.Info{}, AppEnv: "production"}
+	store, search, err := initDataStores(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		search.Close()
+		store.Close()
+	})
+	return &importer{
+		store:       store,
+		search:      search,
+		tombstones:  tombstone.NewStore(store.DB),
+		vanisher:    vanish.New(store.DB, store, manager.NewManager(store.DB)),
+		expirations: expiration.NewIndex(store.DB, store),
+		counts:      hll.NewStore(store.DB, store),
+	}
+}
+
+func TestImportTombstones(t *testing.T) {
+	imp := newTestImporter(t)
+	author, _ := nostr.GetPublicKey(testSecretKey)
+	now := nostr.Now()
+	sign := func(evt nostr.Event) nostr.Event {
+		if err := evt.Sign(testSecretKey); err != nil {
+			t.Fatal(err)
+		}
+		return evt
+	}
+
+	imported := sign(nostr.Event{Kind: nostr.KindTextNote, CreatedAt: now - 100, Content: "imported, then deleted"})
+	unseen := sign(nostr.Event{Kind: nostr.KindTextNote, CreatedAt: now - 90, Content: "deleted before its import"})
+	oldArticle := sign(nostr.Event{Kind: nostr.KindArticle, CreatedAt: now - 80, Tags: nostr.Tags{{"d", "post"}}})
+	newArticle := sign(nostr.Event{Kind: nostr.KindArticle, CreatedAt: now + 10, Tags: nostr.Tags{{"d", "post"}}})
+	deletion := sign(nostr.Event{Kind: nostr.KindDeletion, CreatedAt: now, Tags: nostr.Tags{
+		{"e", imported.ID},
+		{"e", unseen.ID},
+		{"a", fmt.Sprintf("%d:%s:post", nostr.KindArticle, author)},
+	}})
+
+	var lines bytes.Buffer
+	for _, evt := range []nostr.Event{imported, deletion, unseen, oldArticle, newArticle, imported} {
+		if err := json.NewEncoder(&lines).Encode(evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count, err := imp.importFromJSONL(bufio.NewReader(&lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first copy of the note, the deletion and the newer article
+	if count != 3 {
+		t.Errorf("imported %d events, want 3", count)
+	}
+
+	for _, tt := range []struct {
+		name string
+		evt  nostr.Event
+		kept bool
+	}{
+		{name: "event deleted after its import", evt: imported, kept: false},
+		{name: "event deleted before its import", evt: unseen, kept: false},
+		{name: "deleted address", evt: oldArticle, kept: false},
+		{name: "newer version of the address", evt: newArticle, kept: true},
+	} {
+		ch, err := imp.store.QueryEvents(context.Background(), nostr.Filter{IDs: []string{tt.evt.ID}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for range ch {
+			found = true
+		}
+		if found != tt.kept {
+			t.Errorf("%s: stored = %v, want %v", tt.name, found, tt.kept)
+		}
+	}
+}
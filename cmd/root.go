@@ -5,9 +5,13 @@ import (
 	"os"
 )
 
+// Version is the build version, injected by the Makefile with -ldflags "-X SimpleNosrtRelay/cmd.Version=...".
+var Version = "dev"
+
 var rootCmd = &cobra.Command{
-	Use:   "nrs",
-	Short: "A Simple Nostr Relay Server",
+	Use:     "nrs",
+	Short:   "A Simple Nostr Relay Server",
+	Version: Version,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
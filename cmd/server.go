@@ -1,12 +1,24 @@
 package cmd
 
 import (
+	"SimpleNosrtRelay/infra/access"
+	"SimpleNosrtRelay/infra/admin"
 	"SimpleNosrtRelay/infra/blob"
+	"SimpleNosrtRelay/infra/community"
 	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/expiration"
+	"SimpleNosrtRelay/infra/groups"
+	"SimpleNosrtRelay/infra/hll"
 	"SimpleNosrtRelay/infra/log"
 	"SimpleNosrtRelay/infra/manager"
 	"SimpleNosrtRelay/infra/metrics"
+	"SimpleNosrtRelay/infra/nip05"
+	"SimpleNosrtRelay/infra/pow"
+	"SimpleNosrtRelay/infra/relayinfo"
+	"SimpleNosrtRelay/infra/report"
 	"SimpleNosrtRelay/infra/stream"
+	"SimpleNosrtRelay/infra/tombstone"
+	"SimpleNosrtRelay/infra/vanish"
 	"context"
 	"fmt"
 	"github.com/fiatjaf/eventstore/bluge"
@@ -14,12 +26,12 @@ import (
 	"github.com/fiatjaf/khatru/blossom"
 	"github.com/fiatjaf/khatru/policies"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip86"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"time"
 )
@@ -34,7 +46,6 @@ var serverCmd = &cobra.Command{
 func runServer(cmd *cobra.Command, args []string) {
 	if err := config.InitConfig(); err != nil {
 		panic(err)
-		return
 	}
 
 	baseDir, _ := filepath.Abs(config.Cfg.BasePath)
@@ -46,15 +57,12 @@ func runServer(cmd *cobra.Command, args []string) {
 	// create the relay instance
 	relay := khatru.NewRelay()
 
-	// set up some basic properties (will be returned on the NIP-11 endpoint)
-	relay.Info.Name = config.Cfg.Info.Name
-	relay.Info.PubKey = config.Cfg.Info.PubKey
-	relay.Info.Description = config.Cfg.Info.Description
-	relay.Info.Icon = config.Cfg.Info.Icon
-	relay.Info.URL = config.Cfg.Info.Url
-	relay.Info.Software = "https://github.com/gabrielmoura/SimpleNosrtRelay"
-	relay.Info.Version = "1.0.0"
+	// set up the NIP-11 document from the configuration; features add their NIPs as they are wired
+	relayinfo.Populate(relay.Info, Version)
 	relay.Negentropy = config.Cfg.Negentropy
+	if relay.Negentropy {
+		relay.Info.AddSupportedNIP(77)
+	}
 
 	relay.OnConnect = append(relay.OnConnect, khatru.RequestAuth)
 
@@ -63,11 +71,6 @@ func runServer(cmd *cobra.Command, args []string) {
 		log.Logger.Fatal("Failed to initialize Badger store", zap.Error(err))
 	}
 
-	m := manager.NewManager(store.DB)
-	relay.ManagementAPI.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
-		return m.ListBannedPubKeys()
-	}
-
 	rls := stream.InitStream(&stream.RelaPool{
 		Relays:     config.Cfg.Stream.Relays,
 		StreamPoll: make([]*nostr.Relay, 0),
@@ -82,11 +85,45 @@ func runServer(cmd *cobra.Command, args []string) {
 		return
 	}
 
+	// the manager shares the event store's database, so it can only be created once it is open
+	m := manager.NewManager(store.DB)
+	if migrated, err := m.MigrateResources(); err != nil {
+		log.Logger.Fatal("Failed to migrate legacy resources", zap.Error(err))
+	} else if migrated > 0 {
+		log.Logger.Info("Migrated legacy resources to roles", zap.Int("pubkeys", migrated))
+	}
+
 	search := bluge.BlugeBackend{Path: filepath.Join(baseDir, "search"), RawEventStore: store}
 	if err := search.Init(); err != nil {
 		panic(err)
 	}
 
+	// expiring events (NIP-40) are indexed by expiration time so the purge never scans the whole database
+	expirations := expiration.NewIndex(store.DB, store)
+	if indexed, err := expirations.Backfill(context.Background()); err != nil {
+		log.Logger.Fatal("Failed to index expiring events", zap.Error(err))
+	} else if indexed > 0 {
+		log.Logger.Info("Indexed expiring events", zap.Int("events", indexed))
+	}
+	if interval := config.Cfg.Expiration.PurgeInterval; interval > 0 {
+		go expirations.StartPurge(context.Background(), interval, store.DeleteEvent, search.DeleteEvent)
+	}
+	relay.Info.AddSupportedNIP(40)
+
+	// requests to vanish (NIP-62) erase their author everywhere; blob hooks are added once blossom is set up
+	vanisher := vanish.New(store.DB, store, m)
+	vanisher.DeleteEvent = append(vanisher.DeleteEvent, store.DeleteEvent, search.DeleteEvent)
+	relay.Info.AddSupportedNIP(62)
+	relay.Info.AddSupportedNIP(70)
+
+	// follower and reaction counts (NIP-45) are kept as HyperLogLog registers updated at write time
+	counts := hll.NewStore(store.DB, store)
+	if counted, err := counts.Backfill(context.Background()); err != nil {
+		log.Logger.Fatal("Failed to count stored follow lists and reactions", zap.Error(err))
+	} else if counted > 0 {
+		log.Logger.Info("Counted follow lists and reactions", zap.Int("events", counted))
+	}
+
 	// StoreEvent is a list of functions that will be called in order to store an event
 	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent, func(ctx context.Context, event *nostr.Event) error {
 		metrics.NostrKindEventCounter.WithLabelValues(strconv.Itoa(event.Kind)).Inc()
@@ -97,24 +134,81 @@ func runServer(cmd *cobra.Command, args []string) {
 			}
 		}
 		return nil
-	}, search.SaveEvent, rls.ForwardEvent(), m.SaveEvent)
+	}, search.SaveEvent, expirations.SaveEvent, counts.SaveEvent, rls.ForwardEvent(), m.SaveEvent, vanisher.SaveEvent)
+
+	// private kinds (DMs, gift wraps...) are only readable by their authenticated author or recipients
+	readPolicy := access.NewReadPolicy(m)
 
 	// QueryEvents is a list of functions that will be called in order to query events
-	relay.QueryEvents = append(relay.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	relay.QueryEvents = append(relay.QueryEvents, readPolicy.QueryEvents(expirations.QueryEvents(func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
 		for _, kind := range filter.Kinds {
 			metrics.NostrKindReqCounter.WithLabelValues(strconv.Itoa(kind)).Inc()
 		}
 		return store.QueryEvents(ctx, filter)
-	}, search.QueryEvents)
+	})), readPolicy.QueryEvents(expirations.QueryEvents(search.QueryEvents)))
+	relay.Info.AddSupportedNIP(50)
+
+	// PreventBroadcast keeps live private events away from other listeners
+	relay.PreventBroadcast = append(relay.PreventBroadcast, readPolicy.PreventBroadcast)
 
 	// DeleteEvent is a list of functions that will be called in order to delete an event
 	relay.DeleteEvent = append(relay.DeleteEvent, store.DeleteEvent, search.DeleteEvent)
+	relay.Info.AddSupportedNIP(9)
 
 	// ReplaceEvent is a list of functions that will be called in order to replace an event
-	relay.ReplaceEvent = append(relay.ReplaceEvent, store.ReplaceEvent, search.ReplaceEvent)
+	// relay actions (kind 35000) are addressable, so the manager must see them here rather than in StoreEvent
+	relay.ReplaceEvent = append(relay.ReplaceEvent, store.ReplaceEvent, search.ReplaceEvent, expirations.SaveEvent, counts.SaveEvent, m.SaveEvent)
+
+	// pubkeys holding the delete-others permission may delete events they did not author,
+	// and every accepted deletion leaves a tombstone so the event cannot come back
+	tombstones := tombstone.NewStore(store.DB)
+	relay.OverwriteDeletionOutcome = append(relay.OverwriteDeletionOutcome, tombstones.OverwriteDeletionOutcome(m.OverwriteDeletionOutcome))
+	relay.OverwriteResponseEvent = append(relay.OverwriteResponseEvent, tombstones.OverwriteResponseEvent)
+	if maxAge := config.Cfg.Tombstones.MaxAge; maxAge > 0 {
+		go tombstones.StartPurge(context.Background(), maxAge, time.Hour)
+	}
 
 	// CountEvents is a list of functions that will be called in order to count events
 	relay.CountEvents = append(relay.CountEvents, store.CountEvents)
+	relay.CountEventsHLL = append(relay.CountEventsHLL, counts.CountEventsHLL)
+	relay.Info.AddSupportedNIP(45)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, readPolicy.RejectCountFilter)
+
+	// moderated communities (NIP-72) only serve posts to their readers once a moderator approved them
+	communities := community.New(store.DB, store)
+	if indexed, err := communities.Backfill(context.Background()); err != nil {
+		log.Logger.Fatal("Failed to index community posts", zap.Error(err))
+	} else if indexed > 0 {
+		log.Logger.Info("Indexed community posts and approvals", zap.Int("events", indexed))
+	}
+	relay.StoreEvent = append(relay.StoreEvent, communities.SaveEvent)
+	relay.ReplaceEvent = append(relay.ReplaceEvent, communities.SaveEvent)
+	for i, query := range relay.QueryEvents {
+		relay.QueryEvents[i] = communities.QueryEvents(query)
+	}
+	relay.Info.AddSupportedNIP(72)
+
+	// reports (NIP-56) feed a moderation queue; content reported by enough trusted reporters is hidden
+	reports := report.NewQueue(store.DB, store, m)
+	reports.DeleteEvent = append(reports.DeleteEvent, store.DeleteEvent, search.DeleteEvent)
+	if indexed, err := reports.Backfill(context.Background()); err != nil {
+		log.Logger.Fatal("Failed to index reports", zap.Error(err))
+	} else if indexed > 0 {
+		log.Logger.Info("Indexed reports", zap.Int("events", indexed))
+	}
+	relay.StoreEvent = append(relay.StoreEvent, reports.SaveEvent)
+	relay.PreventBroadcast = append(relay.PreventBroadcast, reports.PreventBroadcast)
+	for i, query := range relay.QueryEvents {
+		relay.QueryEvents[i] = reports.QueryEvents(query)
+	}
+	relay.Info.AddSupportedNIP(56)
+
+	// proof of work (NIP-13) is required per kind, lowered for invited members and role holders
+	powPolicy := pow.NewPolicy(m)
+	if pow.Enabled() {
+		relay.Info.AddSupportedNIP(13)
+	}
+	relay.Info.Limitation = relayinfo.Limitation(relay, store.MaxLimit, pow.MinDifficulty(), pow.Enabled())
 
 	// RejectEvent is a list of functions that will be called in order to reject an event
 	relay.RejectEvent = append(relay.RejectEvent,
@@ -132,13 +226,20 @@ func runServer(cmd *cobra.Command, args []string) {
 		// define your own policies
 		policies.PreventLargeTags(120),
 		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-			if event.PubKey == "fa984bd7dbb282f07e16e7ae87b26a2a7b9b90b7246a44771f0cf5ae58018f52" {
+			if slices.Contains(config.Cfg.BlockedPubKeys, event.PubKey) {
 				return true, "we don't allow this person to write here"
 			}
 			return false, "" // anyone else can
 		},
 		policies.RejectEventsWithBase64Media,
+		powPolicy.RejectEvent,
+		access.RejectProtected,
+		expirations.RejectEvent,
 		m.RejectEvent(),
+		tombstones.RejectEvent,
+		vanisher.RejectEvent,
+		communities.RejectEvent,
+		reports.RejectEvent,
 	)
 
 	// you can request auth by rejecting an event or a request with the prefix "auth-required: "
@@ -155,9 +256,38 @@ func runServer(cmd *cobra.Command, args []string) {
 			}
 			return false, ""
 		},
+		readPolicy.RejectFilter,
 	)
 	// check the docs for more goodies!
 
+	// NIP-29 groups: membership lives in the Manager and the relay key signs the group state
+	if config.Cfg.Groups.Enabled {
+		groupsHost, err := groups.New(m, store, config.Cfg.Groups.SecretKey)
+		if err != nil {
+			log.Logger.Fatal("Failed to set up groups", zap.Error(err))
+		}
+		groupsHost.Publish = func(ctx context.Context, evt *nostr.Event) error {
+			for _, replace := range relay.ReplaceEvent {
+				if err := replace(ctx, evt); err != nil {
+					return err
+				}
+			}
+			relay.BroadcastEvent(evt)
+			return nil
+		}
+		groupsHost.DeleteEvent = append(groupsHost.DeleteEvent, store.DeleteEvent, search.DeleteEvent)
+
+		relay.StoreEvent = append(relay.StoreEvent, groupsHost.SaveEvent)
+		relay.RejectEvent = append(relay.RejectEvent, groupsHost.RejectEvent)
+		relay.RejectFilter = append(relay.RejectFilter, groupsHost.RejectFilter)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, groupsHost.RejectFilter)
+		relay.PreventBroadcast = append(relay.PreventBroadcast, groupsHost.PreventBroadcast)
+		for i, query := range relay.QueryEvents {
+			relay.QueryEvents[i] = groupsHost.QueryEvents(query)
+		}
+		relay.Info.AddSupportedNIP(29)
+	}
+
 	mux := relay.Router()
 	// set up other http handlers
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -166,33 +296,73 @@ func runServer(cmd *cobra.Command, args []string) {
 	})
 	mux.Handle("/metrics", promhttp.Handler())
 
+	if config.Cfg.Nip05.Enabled {
+		mux.Handle("/.well-known/nostr.json", nip05.NewServer(m, store))
+	}
+
 	bl := blossom.New(relay, relay.Info.URL)
 
-	// create a database for keeping track of blob metadata
-	bl.Store = blossom.EventStoreBlobIndexWrapper{
-		Store:      store,
-		ServiceURL: bl.ServiceURL,
+	blobConfig, err := newBlobConfig(baseDir, bl.ServiceURL)
+	if err != nil {
+		log.Logger.Fatal("Failed to configure blob storage", zap.Error(err))
 	}
+	bs := blob.NewBlobStore(store.DB, blobConfig)
 
-	bs := blob.NewBlobStore(store.DB, &blob.Config{
-		BasePath:       filepath.Join(baseDir, "blobs"),
-		ExtAcceptable:  []string{".jpg", ".gif", ".png", ".webp", ".mp4"},
-		MaxFileSize:    10 * 1024 * 1024, // 10MB
-		MimeAcceptable: []string{"image/png", "image/jpeg", "image/gif", "image/webp", "video/mp4", "video/webm", "video/ogg"},
-		AuthRequired:   config.Cfg.Blossom.AuthRequired,
-	})
+	if err := bs.Init(); err != nil {
+		log.Logger.Fatal("Failed to initialize the blob storage", zap.Error(err))
+	}
 
-	bs.Init()
+	// blob metadata (owners, size, type, last access) is indexed in Badger by the blob store itself
+	if moved, err := bs.Backfill(context.Background(), store); err != nil {
+		log.Logger.Fatal("Failed to index blob metadata", zap.Error(err))
+	} else if moved > 0 {
+		log.Logger.Info("Indexed blob metadata", zap.Int("blobs", moved))
+	}
+	bl.Store = bs
 
 	// implement the required storage functions
-	bl.StoreBlob = append(bl.StoreBlob, bs.StoreBlob)
+	bl.StoreBlob = append(bl.StoreBlob, bs.StoreBlob, bs.ProcessImage)
 	bl.LoadBlob = append(bl.LoadBlob, bs.LoadBlob)
 	bl.DeleteBlob = append(bl.DeleteBlob, bs.DeleteBlob)
 	bl.RejectUpload = append(bl.RejectUpload, bs.RejectUpload(authorizeBlossom(m)))
 
+	// storage quotas and lifetimes come from the roles held in the Manager; /usage/<pubkey>
+	// shows what is left
+	bs.Quota = m.BlobQuota
+	bs.Lifetime = m.BlobLifetime
+	if interval := config.Cfg.Blossom.Retention.Interval; interval > 0 {
+		go bs.StartExpire(context.Background(), interval)
+	}
+	mux.Handle("/usage/", bs.UsageHandler())
+	mux.Handle("/thumbs/", bs.ThumbnailHandler())
+
+	vanisher.Blobs = bl.Store
+	vanisher.DeleteBlob = append(vanisher.DeleteBlob, bs.DeleteBlob)
+
+	// blobs left without owners, or owned only by banned and vanished pubkeys, are collected
+	if interval := config.Cfg.Blossom.GCInterval; interval > 0 {
+		go bs.StartGC(context.Background(), interval, blobOwnerGone(m, vanisher))
+	}
+
+	// BUD-04 mirrors and BUD-06 preflights go through the same RejectUpload policies as uploads
+	mirrorClient, err := blob.NewMirrorClient(blob.MirrorConfig{
+		Proxy:   config.Cfg.Blossom.Mirror.Proxy,
+		Timeout: config.Cfg.Blossom.Mirror.Timeout,
+	})
+	if err != nil {
+		log.Logger.Fatal("Failed to configure blob mirroring", zap.Error(err))
+	}
+	uploads := bs.NewUploads(bl, mirrorClient)
+
+	// management API calls are answered by the Manager before reaching the relay,
+	// and uploads have their bytes checked before reaching blossom
+	adminAPI := admin.NewAPI(m)
+	adminAPI.Communities = communities
+	adminAPI.Reports = reports
+
 	// start the server
 	log.Logger.Info("running on :3334")
-	http.ListenAndServe(":3334", relay)
+	http.ListenAndServe(":3334", relayinfo.Handler(relay, adminAPI.Handler(uploads.Handler(bs.ValidateUploads(relay)))))
 }
 func init() {
 	rootCmd.AddCommand(serverCmd)
@@ -202,7 +372,7 @@ func authorizeBlossom(m *manager.Manager) func(auth *nostr.Event) bool {
 		if auth.PubKey == config.Cfg.Info.PubKey {
 			return true
 		}
-		err := m.ValidateResource(auth.PubKey, manager.ResourceBlossom)
+		err := m.ValidatePermission(auth.PubKey, manager.PermUpload)
 		if err == nil {
 			return true
 		}
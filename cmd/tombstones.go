@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/tombstone"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var tombstonesCmd = &cobra.Command{
+	Use:   "tombstones",
+	Short: "Manage NIP-09 deletion tombstones",
+}
+
+var tombstonesPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Remove old deletion tombstones",
+	Long: `Remove tombstones recorded longer ago than --older-than (defaults to tombstones.max_age).
+Events whose tombstone was purged can be published or imported again.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := config.InitConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to initialize configuration:", err)
+			os.Exit(1)
+		}
+		log.Init()
+
+		maxAge := config.Cfg.Tombstones.MaxAge
+		if cmd.Flags().Changed("older-than") {
+			maxAge, _ = cmd.Flags().GetDuration("older-than")
+		}
+		if maxAge <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: set --older-than or tombstones.max_age to a positive duration")
+			os.Exit(1)
+		}
+
+		baseDir, err := getAbsBaseDir()
+		if err != nil {
+			log.Logger.Fatal("Failed to get absolute path", zap.Error(err))
+		}
+		store, err := initBadgerStore(baseDir)
+		if err != nil {
+			log.Logger.Fatal("Failed to initialize Badger store", zap.Error(err))
+		}
+		if err := store.Init(); err != nil {
+			log.Logger.Fatal("Failed to initialize event store", zap.Error(err))
+		}
+		defer store.Close()
+
+		n, err := tombstone.NewStore(store.DB).Purge(maxAge)
+		if err != nil {
+			log.Logger.Fatal("Failed to purge tombstones", zap.Error(err))
+		}
+		fmt.Printf("Purged %d tombstones\n", n)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tombstonesCmd)
+	tombstonesCmd.AddCommand(tombstonesPurgeCmd)
+	tombstonesPurgeCmd.Flags().Duration("older-than", 0, "Purge tombstones recorded longer ago than this")
+}
@@ -0,0 +1,153 @@
+// Package access restricts who may read events of private kinds (DMs, gift wraps,
+// DM relay lists...): only a NIP-42 authenticated author or p-tagged recipient sees them,
+// both in stored query results and in live broadcasts. It also guards NIP-70 protected
+// events, which only their authenticated author may publish, and keeps pubkeys whose
+// roles lack the read permission from querying at all.
+package access
+
+import (
+	"SimpleNosrtRelay/infra/manager"
+	"context"
+	"slices"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QueryFunc matches the signature of khatru's QueryEvents hooks.
+type QueryFunc func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+
+// ReadPolicy enforces read access to private kinds.
+type ReadPolicy struct {
+	m *manager.Manager
+}
+
+// NewReadPolicy creates a ReadPolicy protecting the private kinds kept by m, which can be
+// changed at runtime through the management API, and looking up roles through m.
+func NewReadPolicy(m *manager.Manager) *ReadPolicy {
+	return &ReadPolicy{m: m}
+}
+
+// IsPrivate reports whether kind is protected.
+func (p *ReadPolicy) IsPrivate(kind int) bool {
+	return p.m.IsPrivateKind(kind)
+}
+
+// CanRead reports whether pubkey may read evt.
+func (p *ReadPolicy) CanRead(pubkey string, evt *nostr.Event) bool {
+	if !p.IsPrivate(evt.Kind) {
+		return true
+	}
+	if pubkey == "" {
+		return false
+	}
+	if evt.PubKey == pubkey {
+		return true
+	}
+	return evt.Tags.GetFirst([]string{"p", pubkey}) != nil
+}
+
+// RejectFilter asks for authentication when a filter only targets private kinds,
+// so clients authenticate before their DMs are silently filtered out. Authenticated
+// pubkeys whose roles do not grant read are refused.
+func (p *ReadPolicy) RejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	if authed := khatru.GetAuthed(ctx); authed != "" {
+		if p.m.Denies(authed, manager.PermRead) {
+			return true, "restricted: your roles do not allow reading"
+		}
+		return false, ""
+	}
+	if len(filter.Kinds) == 0 {
+		return false, ""
+	}
+	for _, kind := range filter.Kinds {
+		if !p.IsPrivate(kind) {
+			return false, ""
+		}
+	}
+	return true, "auth-required: this query is restricted to authenticated participants"
+}
+
+// RejectCountFilter refuses counts that could include private events, unless the
+// filter is limited to events authored by or addressed to the authenticated pubkey,
+// since counts cannot be filtered event by event.
+func (p *ReadPolicy) RejectCountFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	authed := khatru.GetAuthed(ctx)
+	if authed != "" && p.m.Denies(authed, manager.PermRead) {
+		return true, "restricted: your roles do not allow reading"
+	}
+	if len(filter.Kinds) > 0 && !slices.ContainsFunc(filter.Kinds, p.IsPrivate) {
+		return false, ""
+	}
+	if authed == "" {
+		return true, "auth-required: counting private kinds requires authentication"
+	}
+	if len(filter.Authors) == 1 && filter.Authors[0] == authed {
+		return false, ""
+	}
+	if pTags := filter.Tags["p"]; len(pTags) == 1 && pTags[0] == authed {
+		return false, ""
+	}
+	return true, "restricted: can only count your own private events"
+}
+
+// QueryEvents wraps query, dropping private events the requesting connection may not read.
+// Internal queries (no websocket connection in ctx) are left untouched so expiration,
+// deletion and replacement keep seeing every event.
+func (p *ReadPolicy) QueryEvents(query QueryFunc) QueryFunc {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || ch == nil || khatru.GetConnection(ctx) == nil {
+			return ch, err
+		}
+
+		authed := khatru.GetAuthed(ctx)
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for evt := range ch {
+				if !p.CanRead(authed, evt) {
+					continue
+				}
+				select {
+				case out <- evt:
+				case <-ctx.Done():
+					// keep draining ch so the underlying query can finish
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// IsProtected reports whether evt carries the NIP-70 ["-"] tag, meaning only its author
+// may publish it and it must not be republished to other relays.
+func IsProtected(evt *nostr.Event) bool {
+	for _, tag := range evt.Tags {
+		if len(tag) == 1 && tag[0] == "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// RejectProtected refuses protected events unless the connection is authenticated as their author.
+// khatru already checks websocket publishes; this also covers events added by other paths.
+func RejectProtected(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if !IsProtected(evt) {
+		return false, ""
+	}
+	switch khatru.GetAuthed(ctx) {
+	case evt.PubKey:
+		return false, ""
+	case "":
+		return true, "auth-required: protected events must be published by their author"
+	default:
+		return true, "blocked: protected events must be published by their author"
+	}
+}
+
+// PreventBroadcast keeps private events from reaching listeners that may not read them.
+func (p *ReadPolicy) PreventBroadcast(ws *khatru.WebSocket, evt *nostr.Event) bool {
+	return !p.CanRead(ws.AuthedPublicKey, evt)
+}
@@ -0,0 +1,160 @@
+package access
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+const (
+	authorKey    = "000000000000000000000000000000000000000000000000000000000000000a"
+	recipientKey = "000000000000000000000000000000000000000000000000000000000000000b"
+)
+
+// newTestRelay serves a relay whose store holds a public note, a DM from the author to the
+// recipient and a gift wrap for the recipient, with kinds 4 and 1059 private.
+func newTestRelay(t *testing.T) string {
+	t.Helper()
+	log.Logger = zap.NewNop()
+	config.Cfg = &config.Config{
+		Info:         &config.Info{},
+		Roles:        config.DefaultRoles,
+		PrivateKinds: []int{nostr.KindEncryptedDirectMessage, nostr.KindGiftWrap},
+	}
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	policy := NewReadPolicy(manager.NewManager(db))
+
+	store := &slicestore.SliceStore{}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	recipient, _ := nostr.GetPublicKey(recipientKey)
+	for _, evt := range []nostr.Event{
+		{Kind: nostr.KindTextNote, Content: "public"},
+		{Kind: nostr.KindEncryptedDirectMessage, Content: "dm", Tags: nostr.Tags{{"p", recipient}}},
+		{Kind: nostr.KindGiftWrap, Content: "wrap", Tags: nostr.Tags{{"p", recipient}}},
+	} {
+		evt.CreatedAt = nostr.Now()
+		if err := evt.Sign(authorKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveEvent(context.Background(), &evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	relay := khatru.NewRelay()
+	relay.QueryEvents = append(relay.QueryEvents, policy.QueryEvents(store.QueryEvents))
+	relay.RejectFilter = append(relay.RejectFilter, policy.RejectFilter)
+	server := httptest.NewServer(relay)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// query returns the stored events matching filter, or the reason the relay closed the subscription.
+func query(t *testing.T, r *nostr.Relay, filter nostr.Filter) ([]*nostr.Event, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := r.Subscribe(ctx, nostr.Filters{filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsub()
+
+	var events []*nostr.Event
+	for {
+		select {
+		case evt := <-sub.Events:
+			events = append(events, evt)
+		case <-sub.EndOfStoredEvents:
+			return events, ""
+		case reason := <-sub.ClosedReason:
+			return events, reason
+		case <-ctx.Done():
+			t.Fatal("no EOSE from the relay")
+		}
+	}
+}
+
+func kinds(events []*nostr.Event) []int {
+	var kinds []int
+	for _, evt := range events {
+		kinds = append(kinds, evt.Kind)
+	}
+	return kinds
+}
+
+func TestPrivateKinds(t *testing.T) {
+	url := newTestRelay(t)
+	author, _ := nostr.GetPublicKey(authorKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		filter nostr.Filter
+	}{
+		{name: "dms", filter: nostr.Filter{Kinds: []int{nostr.KindEncryptedDirectMessage}}},
+		{name: "gift wraps", filter: nostr.Filter{Kinds: []int{nostr.KindGiftWrap}}},
+		{name: "both", filter: nostr.Filter{Kinds: []int{nostr.KindEncryptedDirectMessage, nostr.KindGiftWrap}}},
+	} {
+		t.Run("unauthenticated "+tt.name, func(t *testing.T) {
+			events, reason := query(t, r, tt.filter)
+			if len(events) != 0 {
+				t.Errorf("got kinds %v, want none", kinds(events))
+			}
+			if !strings.HasPrefix(reason, "auth-required:") {
+				t.Errorf("closed reason = %q, want auth-required", reason)
+			}
+		})
+	}
+
+	t.Run("unauthenticated mixed", func(t *testing.T) {
+		for _, filter := range []nostr.Filter{
+			{Kinds: []int{nostr.KindTextNote, nostr.KindEncryptedDirectMessage, nostr.KindGiftWrap}},
+			{Authors: []string{author}},
+		} {
+			events, reason := query(t, r, filter)
+			if reason != "" {
+				t.Fatalf("closed: %s", reason)
+			}
+			if got := kinds(events); len(got) != 1 || got[0] != nostr.KindTextNote {
+				t.Errorf("%v: got kinds %v, want only the public note", filter, got)
+			}
+		}
+	})
+
+	t.Run("authenticated recipient", func(t *testing.T) {
+		if err := r.Auth(ctx, func(evt *nostr.Event) error { return evt.Sign(recipientKey) }); err != nil {
+			t.Fatal(err)
+		}
+		events, reason := query(t, r, nostr.Filter{Kinds: []int{nostr.KindEncryptedDirectMessage, nostr.KindGiftWrap}})
+		if reason != "" {
+			t.Fatalf("closed: %s", reason)
+		}
+		if len(events) != 2 {
+			t.Errorf("got kinds %v, want the dm and the gift wrap", kinds(events))
+		}
+	})
+}
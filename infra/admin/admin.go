@@ -0,0 +1,315 @@
+// Package admin exposes the Manager's administrative operations over the NIP-86
+// relay management API, extending the standard method set with invites, unbans,
+// role grants and the community and report moderation queues, and provides a client
+// for calling it.
+package admin
+
+import (
+	"SimpleNosrtRelay/infra/community"
+	"SimpleNosrtRelay/infra/identity"
+	"SimpleNosrtRelay/infra/manager"
+	"SimpleNosrtRelay/infra/nip98"
+	"SimpleNosrtRelay/infra/report"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/nbd-wtf/go-nostr/sdk"
+)
+
+// ContentType is the content type of NIP-86 requests and responses.
+const ContentType = "application/nostr+json+rpc"
+
+var (
+	ErrUnknownMethod = errors.New("method not known")
+	ErrInvalidParams = errors.New("invalid params")
+	ErrUnauthorized  = errors.New("unauthorized")
+)
+
+// API dispatches management methods to the Manager.
+type API struct {
+	m *manager.Manager
+	// Communities answers listpendingposts; the method fails while it is nil.
+	Communities *community.Moderation
+	// Reports answers listreports and resolvereport; the methods fail while it is nil.
+	Reports *report.Queue
+}
+
+// NewAPI creates a new API backed by m.
+func NewAPI(m *manager.Manager) *API {
+	return &API{m: m}
+}
+
+// methods lists every method handled by API, in the order returned by supportedmethods.
+var methods = []string{
+	"supportedmethods",
+	"allowpubkey",
+	"banpubkey",
+	"unbanpubkey",
+	"grantrole",
+	"revokerole",
+	"listallowedpubkeys",
+	"listbannedpubkeys",
+	"showpubkey",
+	"claimname",
+	"releasename",
+	"listnames",
+	"listpendingposts",
+	"listreports",
+	"resolvereport",
+	"listprivatekinds",
+	"addprivatekind",
+	"removeprivatekind",
+}
+
+// Dispatch runs method with params without any authorization check.
+// Callers are expected to have authorized the request already.
+func (a *API) Dispatch(ctx context.Context, method string, params []any) (any, error) {
+	switch method {
+	case "supportedmethods":
+		return methods, nil
+	case "allowpubkey":
+		pubkey, err := pubKeyParam(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return true, a.m.Invite(pubkey, sdk.ProfileMetadata{Name: stringParam(params, 1)})
+	case "banpubkey":
+		pubkey, err := pubKeyParam(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return true, a.m.Ban(pubkey, stringParam(params, 1))
+	case "unbanpubkey":
+		pubkey, err := pubKeyParam(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return true, a.m.Unban(pubkey)
+	case "grantrole", "revokerole":
+		pubkey, err := pubKeyParam(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		role, err := manager.ParseRole(stringParam(params, 1))
+		if err != nil {
+			return nil, err
+		}
+		if method == "grantrole" {
+			return true, a.m.Grant(pubkey, role)
+		}
+		return true, a.m.Revoke(pubkey, role)
+	case "listallowedpubkeys":
+		return a.m.ListInvited()
+	case "listbannedpubkeys":
+		return a.m.ListBannedPubKeys()
+	case "showpubkey":
+		pubkey, err := pubKeyParam(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return a.m.Show(pubkey)
+	case "claimname":
+		pubkey, err := pubKeyParam(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return true, a.m.ClaimName(pubkey, stringParam(params, 1))
+	case "releasename":
+		pubkey, err := pubKeyParam(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		return true, a.m.ReleaseName(pubkey)
+	case "listnames":
+		return a.m.ListNames()
+	case "listpendingposts":
+		addr := stringParam(params, 0)
+		if _, _, ok := community.ParseAddress(addr); !ok {
+			return nil, ErrInvalidParams
+		}
+		if a.Communities == nil {
+			return nil, ErrUnknownMethod
+		}
+		return a.Communities.Pending(ctx, addr)
+	case "listprivatekinds":
+		return a.m.PrivateKinds()
+	case "addprivatekind", "removeprivatekind":
+		kind, err := kindParam(params)
+		if err != nil {
+			return nil, err
+		}
+		return true, a.m.SetPrivateKind(kind, method == "addprivatekind")
+	case "listreports":
+		if a.Reports == nil {
+			return nil, ErrUnknownMethod
+		}
+		return a.Reports.List()
+	case "resolvereport":
+		target := stringParam(params, 0)
+		if !nostr.IsValid32ByteHex(target) {
+			return nil, ErrInvalidParams
+		}
+		if a.Reports == nil {
+			return nil, ErrUnknownMethod
+		}
+		return true, a.Reports.Resolve(ctx, target, report.Action(stringParam(params, 1)))
+	default:
+		return nil, ErrUnknownMethod
+	}
+}
+
+// Authorize checks whether pubkey may call method with params. Invites and NIP-05 names
+// require the invite permission, bans, reports and community queues require ban, and
+// private kinds require manage-kinds; grantrole and revokerole follow Manager.CanGrant.
+// Members may always manage their own NIP-05 name, and community moderators may always
+// see their community's queue.
+func (a *API) Authorize(ctx context.Context, pubkey, method string, params []any) error {
+	var perm manager.Permission
+	switch method {
+	case "supportedmethods":
+		return nil
+	case "allowpubkey", "listallowedpubkeys", "listnames":
+		perm = manager.PermInvite
+	case "claimname", "releasename":
+		if target, err := pubKeyParam(ctx, params); err == nil && target == pubkey {
+			return nil
+		}
+		perm = manager.PermInvite
+	case "banpubkey", "unbanpubkey", "listbannedpubkeys", "showpubkey":
+		perm = manager.PermBan
+	case "listreports", "resolvereport":
+		perm = manager.PermBan
+	case "listpendingposts":
+		if a.Communities != nil && a.Communities.IsModerator(ctx, stringParam(params, 0), pubkey) {
+			return nil
+		}
+		perm = manager.PermBan
+	case "listprivatekinds", "addprivatekind", "removeprivatekind":
+		perm = manager.PermManageKinds
+	case "grantrole", "revokerole":
+		role, err := manager.ParseRole(stringParam(params, 1))
+		if err != nil {
+			return err
+		}
+		if !a.m.CanGrant(pubkey, role) {
+			return ErrUnauthorized
+		}
+		return nil
+	default:
+		return ErrUnauthorized
+	}
+	if err := a.m.ValidatePermission(pubkey, perm); err != nil {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Handler wraps next, answering NIP-86 calls for the methods known by API
+// and passing every other request through untouched.
+func (a *API) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != ContentType || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeResponse(w, nip86.Response{Error: "empty request"})
+			return
+		}
+		var req nip86.Request
+		if err := json.Unmarshal(payload, &req); err != nil {
+			writeResponse(w, nip86.Response{Error: "invalid json body"})
+			return
+		}
+		if !slices.Contains(methods, req.Method) {
+			r.Body = io.NopCloser(bytes.NewReader(payload))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		pubkey, err := authenticate(r, payload)
+		if err != nil {
+			writeResponse(w, nip86.Response{Error: err.Error()})
+			return
+		}
+		if err := a.Authorize(r.Context(), pubkey, req.Method, req.Params); err != nil {
+			writeResponse(w, nip86.Response{Error: err.Error()})
+			return
+		}
+
+		result, err := a.Dispatch(r.Context(), req.Method, req.Params)
+		if err != nil {
+			writeResponse(w, nip86.Response{Error: err.Error()})
+			return
+		}
+		writeResponse(w, nip86.Response{Result: result})
+	})
+}
+
+// authenticate validates the NIP-98 Authorization header of r, which NIP-86 requires to
+// sign payload in a "payload" tag, and returns the authenticated pubkey.
+func authenticate(r *http.Request, payload []byte) (string, error) {
+	evt, err := nip98.Validate(r, payload)
+	if err != nil {
+		return "", err
+	}
+	if evt.Tags.GetFirst([]string{"payload", ""}) == nil {
+		return "", errors.New(`missing "Authorization" event "payload" tag`)
+	}
+	return evt.PubKey, nil
+}
+
+func writeResponse(w http.ResponseWriter, resp nip86.Response) {
+	w.Header().Set("Content-Type", ContentType)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func pubKeyParam(ctx context.Context, params []any) (string, error) {
+	if len(params) == 0 {
+		return "", ErrInvalidParams
+	}
+	raw, ok := params[0].(string)
+	if !ok {
+		return "", ErrInvalidParams
+	}
+	return identity.ParsePubKey(ctx, raw)
+}
+
+// kindParam reads the kind in the first param, a JSON number or, from the command line,
+// a decimal string.
+func kindParam(params []any) (int, error) {
+	if len(params) == 0 {
+		return 0, ErrInvalidParams
+	}
+	switch v := params[0].(type) {
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case string:
+		if kind, err := strconv.Atoi(v); err == nil {
+			return kind, nil
+		}
+	}
+	return 0, ErrInvalidParams
+}
+
+func stringParam(params []any, i int) string {
+	if len(params) <= i {
+		return ""
+	}
+	s, _ := params[i].(string)
+	return s
+}
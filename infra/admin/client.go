@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"SimpleNosrtRelay/infra/nip98"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// Client calls a running relay's management API, signing every request with NIP-98.
+type Client struct {
+	url       string
+	secretKey string
+	http      *http.Client
+}
+
+// NewClient creates a Client for the relay at url, signing with secretKey (hex or nsec).
+func NewClient(url, secretKey string) (*Client, error) {
+	sk, err := parseSecretKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		url:       strings.TrimRight(url, "/"),
+		secretKey: sk,
+		http:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Call invokes method with params and returns the raw JSON result.
+func (c *Client) Call(ctx context.Context, method string, params ...any) (json.RawMessage, error) {
+	if params == nil {
+		params = []any{}
+	}
+	payload, err := json.Marshal(nip86.Request{Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := c.sign(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("Authorization", "Nostr "+auth)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode %s response: %w", method, err)
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	return result.Result, nil
+}
+
+// sign builds the base64 encoded NIP-98 auth event for payload.
+func (c *Client) sign(payload []byte) (string, error) {
+	payloadHash := sha256.Sum256(payload)
+	evt := nostr.Event{
+		Kind:      nip98.KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"u", c.url},
+			{"method", http.MethodPost},
+			{"payload", hex.EncodeToString(payloadHash[:])},
+		},
+	}
+	if err := evt.Sign(c.secretKey); err != nil {
+		return "", fmt.Errorf("failed to sign auth event: %w", err)
+	}
+	raw, err := json.Marshal(evt)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func parseSecretKey(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("missing secret key")
+	}
+	if strings.HasPrefix(raw, "nsec1") {
+		prefix, value, err := nip19.Decode(raw)
+		if err != nil || prefix != "nsec" {
+			return "", errors.New("invalid nsec")
+		}
+		return value.(string), nil
+	}
+	if !nostr.IsValid32ByteHex(raw) {
+		return "", errors.New("invalid secret key")
+	}
+	return raw, nil
+}
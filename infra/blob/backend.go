@@ -0,0 +1,234 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend keeps the bytes of blobs and thumbnails under slash-separated keys
+// ("ab/cd/<sha256>", "thumbs/256/ab/cd/<sha256>"); the index stays in Badger.
+type Backend interface {
+	// Put stores body under key, replacing any previous object. Readers never see a
+	// partially written object.
+	Put(ctx context.Context, key string, body []byte) error
+	// Open returns a reader of the object at key that fetches only what is read, so
+	// range requests do not load whole objects. Missing objects give fs.ErrNotExist.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Stat describes the object at key. Missing objects give fs.ErrNotExist.
+	Stat(ctx context.Context, key string) (Object, error)
+	// Delete removes the object at key; deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// Walk calls fn for every stored object, including leftovers of interrupted writes.
+	Walk(ctx context.Context, fn func(Object) error) error
+}
+
+// Object describes a stored object.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// blobKey is where the blob named hash is kept: sharded by its first two bytes
+// (ab/cd/abcd...) so no directory or listing page grows past a few thousand entries.
+func blobKey(hash string) string {
+	return hash[0:2] + "/" + hash[2:4] + "/" + hash
+}
+
+// LocalBackend keeps objects as files under a base directory.
+type LocalBackend struct {
+	base string
+}
+
+var _ Backend = (*LocalBackend)(nil)
+
+// NewLocalBackend creates a LocalBackend storing files under base.
+func NewLocalBackend(base string) *LocalBackend {
+	return &LocalBackend{base: base}
+}
+
+func (lb *LocalBackend) path(key string) string {
+	return filepath.Join(lb.base, filepath.FromSlash(key))
+}
+
+// Put writes body to a temporary file renamed into place once synced.
+func (lb *LocalBackend) Put(ctx context.Context, key string, body []byte) error {
+	fp := lb.path(key)
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fp), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fp)
+}
+
+func (lb *LocalBackend) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	return os.Open(lb.path(key))
+}
+
+func (lb *LocalBackend) Stat(ctx context.Context, key string) (Object, error) {
+	info, err := os.Stat(lb.path(key))
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (lb *LocalBackend) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(lb.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (lb *LocalBackend) Walk(ctx context.Context, fn func(Object) error) error {
+	return filepath.WalkDir(lb.base, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(lb.base, fp)
+		if err != nil {
+			return err
+		}
+		return fn(Object{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// Init creates the base directory if it doesn't exist and moves blobs left in the flat
+// layout (base/<sha256>) into their shards. Files whose name is not a SHA-256 are left
+// alone; running it again is a no-op. It returns how many blobs were moved.
+func (lb *LocalBackend) Init() (int, error) {
+	if err := os.MkdirAll(lb.base, 0755); err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(lb.base)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !validHash(entry.Name()) {
+			continue
+		}
+		fp := lb.path(blobKey(entry.Name()))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			return migrated, err
+		}
+		if err := os.Rename(filepath.Join(lb.base, entry.Name()), fp); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// MemoryBackend keeps objects in memory; everything is lost on restart, so it is meant
+// for tests and throwaway relays.
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+var _ Backend = (*MemoryBackend)(nil)
+
+// NewMemoryBackend creates an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: make(map[string]memoryObject)}
+}
+
+func (mb *MemoryBackend) Put(ctx context.Context, key string, body []byte) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.objects[key] = memoryObject{data: slices.Clone(body), modTime: time.Now()}
+	return nil
+}
+
+func (mb *MemoryBackend) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	obj, ok := mb.objects[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	// objects are replaced, never modified, so the reader can share the slice
+	return nopCloser{bytes.NewReader(obj.data)}, nil
+}
+
+func (mb *MemoryBackend) Stat(ctx context.Context, key string) (Object, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	obj, ok := mb.objects[key]
+	if !ok {
+		return Object{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+	return Object{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (mb *MemoryBackend) Delete(ctx context.Context, key string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(mb.objects, key)
+	return nil
+}
+
+func (mb *MemoryBackend) Walk(ctx context.Context, fn func(Object) error) error {
+	mb.mu.RLock()
+	objects := make([]Object, 0, len(mb.objects))
+	for key, obj := range mb.objects {
+		objects = append(objects, Object{Key: key, Size: int64(len(obj.data)), ModTime: obj.modTime})
+	}
+	mb.mu.RUnlock()
+
+	slices.SortFunc(objects, func(a, b Object) int { return strings.Compare(a.Key, b.Key) })
+	for _, obj := range objects {
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,357 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The same cases run against every Backend.
+func TestBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"local": func(t *testing.T) Backend {
+			return NewLocalBackend(t.TempDir())
+		},
+		"memory": func(t *testing.T) Backend {
+			return NewMemoryBackend()
+		},
+		"s3": func(t *testing.T) Backend {
+			return newTestS3Backend(t, newFakeS3(t), "blobs")
+		},
+	}
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			t.Run("put and open", func(t *testing.T) { testPutOpen(t, newBackend(t)) })
+			t.Run("put replaces", func(t *testing.T) { testPutReplaces(t, newBackend(t)) })
+			t.Run("missing objects", func(t *testing.T) { testMissing(t, newBackend(t)) })
+			t.Run("delete", func(t *testing.T) { testDelete(t, newBackend(t)) })
+			t.Run("walk", func(t *testing.T) { testWalk(t, newBackend(t)) })
+		})
+	}
+}
+
+const testHash = "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"
+
+func testPutOpen(t *testing.T, b Backend) {
+	ctx := context.Background()
+	body := []byte("hello, blob storage")
+	if err := b.Put(ctx, blobKey(testHash), body); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := b.Stat(ctx, blobKey(testHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Key != blobKey(testHash) || obj.Size != int64(len(body)) {
+		t.Errorf("Stat = %+v, want key %s and size %d", obj, blobKey(testHash), len(body))
+	}
+
+	r, err := b.Open(ctx, blobKey(testHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("read %q, want %q", got, body)
+	}
+
+	// range requests seek before reading
+	if _, err := r.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 4)
+	if _, err := io.ReadFull(r, part); err != nil {
+		t.Fatal(err)
+	}
+	if string(part) != "blob" {
+		t.Errorf("read %q after seeking, want %q", part, "blob")
+	}
+}
+
+func testPutReplaces(t *testing.T, b Backend) {
+	ctx := context.Background()
+	if err := b.Put(ctx, blobKey(testHash), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, blobKey(testHash), []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.Open(ctx, blobKey(testHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, _ := io.ReadAll(r); string(got) != "second" {
+		t.Errorf("read %q, want %q", got, "second")
+	}
+}
+
+func testMissing(t *testing.T, b Backend) {
+	ctx := context.Background()
+	if _, err := b.Stat(ctx, blobKey(testHash)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing object = %v, want fs.ErrNotExist", err)
+	}
+	if r, err := b.Open(ctx, blobKey(testHash)); !errors.Is(err, fs.ErrNotExist) {
+		if r != nil {
+			r.Close()
+		}
+		t.Errorf("Open of a missing object = %v, want fs.ErrNotExist", err)
+	}
+	if err := b.Delete(ctx, blobKey(testHash)); err != nil {
+		t.Errorf("Delete of a missing object = %v, want nil", err)
+	}
+}
+
+func testDelete(t *testing.T, b Backend) {
+	ctx := context.Background()
+	if err := b.Put(ctx, blobKey(testHash), []byte("gone soon")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(ctx, blobKey(testHash)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(ctx, blobKey(testHash)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat after Delete = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func testWalk(t *testing.T, b Backend) {
+	ctx := context.Background()
+	keys := []string{blobKey(testHash), thumbnailKey(testHash, 256), blobKey(strings.Repeat("0", 64))}
+	for _, key := range keys {
+		if err := b.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var walked []string
+	if err := b.Walk(ctx, func(obj Object) error {
+		if obj.Size != int64(len(obj.Key)) {
+			t.Errorf("walked %s with size %d, want %d", obj.Key, obj.Size, len(obj.Key))
+		}
+		walked = append(walked, obj.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	slices.Sort(walked)
+	if !slices.Equal(walked, keys) {
+		t.Errorf("walked %v, want %v", walked, keys)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := b.Walk(ctx, func(Object) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Walk returned %v after %d calls, want the error of fn after 1", err, calls)
+	}
+}
+
+func TestS3BackendPrefix(t *testing.T) {
+	fake := newFakeS3(t)
+	if _, err := NewS3Backend(context.Background(), fakeS3Config(fake, "/")); !errors.Is(err, ErrS3Prefix) {
+		t.Fatalf("NewS3Backend without a prefix = %v, want ErrS3Prefix", err)
+	}
+
+	// objects outside the prefix, even sharing its first letters, are not the relay's
+	fake.put("other/"+blobKey(testHash), []byte("not ours"))
+	fake.put("blobs-old/"+blobKey(testHash), []byte("not ours either"))
+	b := newTestS3Backend(t, fake, "blobs")
+	if err := b.Put(context.Background(), blobKey(testHash), []byte("ours")); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(fake.keys(), "blobs/"+blobKey(testHash)) {
+		t.Errorf("bucket holds %v, want the object under blobs/", fake.keys())
+	}
+
+	var walked []string
+	if err := b.Walk(context.Background(), func(obj Object) error {
+		walked = append(walked, obj.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(walked, []string{blobKey(testHash)}) {
+		t.Errorf("walked %v, want only %s", walked, blobKey(testHash))
+	}
+}
+
+func newTestS3Backend(t *testing.T, fake *fakeS3, prefix string) *S3Backend {
+	t.Helper()
+	b, err := NewS3Backend(context.Background(), fakeS3Config(fake, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func fakeS3Config(fake *fakeS3, prefix string) S3Config {
+	return S3Config{
+		Endpoint:  strings.TrimPrefix(fake.server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    "relay",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Prefix:    prefix,
+		Insecure:  true,
+	}
+}
+
+// fakeS3 answers the path-style S3 calls S3Backend makes, on a single bucket, without
+// checking signatures.
+type fakeS3 struct {
+	server  *httptest.Server
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	fake := &fakeS3{objects: make(map[string]memoryObject)}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = memoryObject{data: data, modTime: time.Now().Truncate(time.Second)}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.put(key, data)
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.mu.Lock()
+		obj, ok := f.objects[key]
+		f.mu.Unlock()
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(obj.data))+`"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", obj.modTime, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+	}
+}
+
+// list answers a ListObjectsV2 request, in a single page.
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []content
+	}{Name: "relay", Prefix: prefix, MaxKeys: 1000}
+	f.mu.Lock()
+	for key, obj := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: obj.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         `"` + strconv.Itoa(len(obj.data)) + `"`,
+				Size:         len(obj.data),
+			})
+		}
+	}
+	f.mu.Unlock()
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readS3Body reads the body of a PUT, decoding the aws-chunked encoding minio-go
+// streams with over plain HTTP.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, n+2) // the chunk and its CRLF
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:n]...)
+	}
+}
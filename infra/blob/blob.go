@@ -4,84 +4,151 @@
 package blob
 
 import (
+	"SimpleNosrtRelay/infra/config"
 	"SimpleNosrtRelay/infra/log"
 	"SimpleNosrtRelay/infra/metrics"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/nbd-wtf/go-nostr"
 	"go.uber.org/zap"
 	"io"
-	"os"
-	"path/filepath"
 	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidHash  = errors.New("invalid sha256")
+	ErrHashMismatch = errors.New("body does not match its sha256")
 )
 
 // Config holds the configuration for the blob store.
 type Config struct {
-	BasePath       string
+	// BasePath is where the local backend keeps blobs.
+	BasePath string
+	// Backend stores the bytes of blobs and thumbnails; a LocalBackend on BasePath when nil.
+	Backend Backend
+	// ServiceURL is the public URL blob descriptors point to.
+	ServiceURL     string
 	MimeAcceptable []string
 	ExtAcceptable  []string
 	MaxFileSize    int
 	AuthRequired   bool
+	Images         ImageConfig
+	Retention      RetentionConfig
 }
 
 // Store represents a store for binary large objects.
 type Store struct {
-	db *badger.DB
-	c  *Config
+	db      *badger.DB
+	c       *Config
+	backend Backend
+	keepMu  sync.Mutex
+	// Quota returns the storage quota of a pubkey; uploads are not limited while it is nil.
+	Quota func(pubkey string) config.Quota
+	// Lifetime returns how long a blob of mimetype uploaded by pubkey is kept, zero being
+	// forever; uploads never expire while it is nil.
+	Lifetime func(pubkey, mimetype string) time.Duration
 }
 
 // NewBlobStore creates a new Store instance.
 func NewBlobStore(db *badger.DB, c *Config) *Store {
-	return &Store{db, c}
+	backend := c.Backend
+	if backend == nil {
+		backend = NewLocalBackend(c.BasePath)
+	}
+	return &Store{db: db, c: c, backend: backend}
 }
 
-// StoreBlob stores a blob with the given SHA256 hash as its file name.
-func (bs *Store) StoreBlob(ctx context.Context, sha256 string, body []byte) error {
+// validHash reports whether hash is a lowercase hex SHA-256, the only names blobs may have.
+func validHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// StoreBlob stores a blob under its SHA256 hash once the body is verified to match it.
+// Backends write objects atomically, so readers never see a partial blob.
+func (bs *Store) StoreBlob(ctx context.Context, hash string, body []byte) error {
+	if !validHash(hash) {
+		return ErrInvalidHash
+	}
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != hash {
+		return ErrHashMismatch
+	}
 	metrics.UploadCounter.Inc()
-	fp := filepath.Join(bs.c.BasePath, sha256)
-	return os.WriteFile(fp, body, 0644)
+	return bs.backend.Put(ctx, blobKey(hash), body)
 }
 
 // LoadBlob retrieves a blob based on its SHA256 hash.
-// It returns an io.ReadSeeker for reading the blob.
-func (bs *Store) LoadBlob(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
+// It returns an io.ReadSeeker streaming the blob from the backend, so range requests only
+// fetch what they ask for. Blossom never closes it, so it is closed once ctx is done.
+func (bs *Store) LoadBlob(ctx context.Context, hash string) (io.ReadSeeker, error) {
+	if !validHash(hash) {
+		return nil, ErrInvalidHash
+	}
+	// clients ask for stripped uploads by the hash they computed
+	if meta, err := bs.Resolve(hash); err == nil && meta != nil {
+		hash = meta.SHA256
+	}
 	metrics.DownloadCounter.Inc()
-	fp := filepath.Join(bs.c.BasePath, sha256)
-	return os.Open(fp)
+	r, err := bs.backend.Open(ctx, blobKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() { r.Close() })
+	if err := bs.touch(hash); err != nil {
+		log.Logger.Warn("Failed to record blob access", zap.String("sha256", hash), zap.Error(err))
+	}
+	return r, nil
 }
 
 // DeleteBlob deletes a blob based on its SHA256 hash.
-func (bs *Store) DeleteBlob(ctx context.Context, sha256 string) error {
-	fp := filepath.Join(bs.c.BasePath, sha256)
-	return os.Remove(fp)
+func (bs *Store) DeleteBlob(ctx context.Context, hash string) error {
+	if !validHash(hash) {
+		return ErrInvalidHash
+	}
+	bs.deleteThumbnails(ctx, hash)
+	return bs.backend.Delete(ctx, blobKey(hash))
 }
 
-// Init initializes the blob storage, creating the base directory if it doesn't exist.
+// Init initializes the blob storage. On local disk it creates the base directory if it
+// doesn't exist and moves blobs left in the flat layout into their shards.
 func (bs *Store) Init() error {
-	// Check if the blobs directory exists; if not, create it.
-	if _, err := os.Stat(bs.c.BasePath); os.IsNotExist(err) {
-		err := os.MkdirAll(bs.c.BasePath, 0755)
-		if err != nil {
-			log.Logger.Error("Error creating blob directory:", zap.Error(err))
-			return err
-		}
+	local, ok := bs.backend.(*LocalBackend)
+	if !ok {
+		return nil
+	}
+	migrated, err := local.Init()
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		log.Logger.Info("Migrated blobs to the sharded layout", zap.Int("blobs", migrated))
 	}
 	return nil
 }
 
 // RejectUpload returns a function that determines if a blob upload should be rejected
-// based on the configuration. It checks for authentication, file size, and extension.
+// based on the configuration. It checks for authentication, file size, extension and quota;
+// size and type limits apply to everyone, authenticated or not. The bytes themselves are
+// checked by ValidateUploads.
 // funcUserAllow: callback function to check if the user is allowed to upload
 func (bs *Store) RejectUpload(funcUserAllow func(auth *nostr.Event) bool) func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
 	return func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
-		// Check if authentication is required.
-		if bs.c.AuthRequired {
-			// If authentication is required and the user is not allowed, reject the upload.
-			if !funcUserAllow(auth) {
-				return true, "restricted: user not allowed to upload", 403
-			}
-			return false, "", 0 // User is authenticated, continue
+		// If authentication is required and the user is not allowed, reject the upload.
+		if bs.c.AuthRequired && !funcUserAllow(auth) {
+			return true, "restricted: user not allowed to upload", 403
 		}
 
 		// Check if the file size exceeds the maximum allowed size.
@@ -93,6 +160,12 @@ func (bs *Store) RejectUpload(funcUserAllow func(auth *nostr.Event) bool) func(c
 			return true, "file type not supported", 415
 		}
 
+		// blobs the uploader already owns do not count again; Keep has the final word
+		if auth != nil && !bs.ownsAny(auth) {
+			if reject, reason, code := bs.rejectOverQuota(auth.PubKey, size); reject {
+				return true, reason, code
+			}
+		}
 		return false, "", 0
 	}
 }
@@ -0,0 +1,228 @@
+package blob
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+)
+
+// staleUpload is how old a temporary upload file, an unindexed object or an index entry
+// without its file must be before the collector assumes its upload died and removes it.
+// Blossom indexes a blob before writing its file, so younger ones may be uploads in flight.
+const staleUpload = time.Hour
+
+// Reasons a blob or file is collected.
+const (
+	ReasonUnowned     = "unowned"      // indexed without any owner
+	ReasonOwnersGone  = "owners-gone"  // every owner was banned or vanished
+	ReasonFileMissing = "file-missing" // indexed, but its file is gone
+	ReasonNotIndexed  = "not-indexed"  // a blob or thumbnail file nobody indexed
+	ReasonStaleUpload = "stale-upload" // a temporary file left by an interrupted upload
+)
+
+// GCEntry is a blob or file the collector removes.
+type GCEntry struct {
+	SHA256 string `json:"sha256,omitempty"`
+	// Path is the backend key of objects found without an index entry.
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason"`
+	// Size is the number of bytes removing the entry frees in the backend.
+	Size int64 `json:"size"`
+}
+
+// GCReport lists what a collection removed, or would remove in a dry run.
+type GCReport struct {
+	DryRun           bool      `json:"dry_run"`
+	Entries          []GCEntry `json:"entries"`
+	ReclaimableBytes int64     `json:"reclaimable_bytes"`
+}
+
+func (r *GCReport) add(entry GCEntry) {
+	r.Entries = append(r.Entries, entry)
+	r.ReclaimableBytes += entry.Size
+}
+
+// GC removes the blobs left without owners, dropping first the owners for whom gone
+// returns true (banned or vanished pubkeys), index entries whose file is missing, and
+// objects in the backend that no index entry accounts for. Index entries and objects
+// younger than staleUpload are left alone. With dryRun nothing is touched and the report
+// tells what would be removed.
+func (bs *Store) GC(ctx context.Context, gone func(pubkey string) bool, dryRun bool) (*GCReport, error) {
+	report := &GCReport{DryRun: dryRun, Entries: []GCEntry{}}
+	// objects written after this may belong to blobs indexed after the snapshot below
+	cutoff := time.Now().Add(-staleUpload)
+
+	var metas []*Meta
+	if err := bs.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte("blob:")})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			meta, err := getMeta(txn, string(it.Item().Key()[len("blob:"):]))
+			if err != nil {
+				return err
+			}
+			metas = append(metas, meta)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// known holds every indexed hash, collected or not, so the walk below does not
+	// report their files a second time
+	known := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !validHash(meta.SHA256) {
+			continue
+		}
+		known[meta.SHA256] = true
+
+		obj, err := bs.backend.Stat(ctx, blobKey(meta.SHA256))
+		if errors.Is(err, fs.ErrNotExist) {
+			if meta.Uploaded.Time().After(cutoff) {
+				continue
+			}
+			report.add(GCEntry{SHA256: meta.SHA256, Reason: ReasonFileMissing})
+			if !dryRun {
+				if err := bs.unindex(meta); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var left []string
+		for _, owner := range meta.Owners {
+			if gone == nil || !gone(owner) {
+				left = append(left, owner)
+			}
+		}
+		if len(left) > 0 {
+			if len(left) < len(meta.Owners) && !dryRun {
+				if err := bs.disown(meta.SHA256, left); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		reason := ReasonOwnersGone
+		if len(meta.Owners) == 0 {
+			reason = ReasonUnowned
+		}
+		report.add(GCEntry{SHA256: meta.SHA256, Reason: reason, Size: obj.Size + bs.thumbnailsSize(ctx, meta.SHA256)})
+		if !dryRun {
+			if err := bs.unindex(meta); err != nil {
+				return nil, err
+			}
+			if err := bs.DeleteBlob(ctx, meta.SHA256); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// objects nobody indexed: blobs and thumbnails named after an unknown hash, and
+	// temporary files of uploads that never finished
+	var orphans []GCEntry
+	err := bs.backend.Walk(ctx, func(obj Object) error {
+		name := path.Base(obj.Key)
+		if obj.ModTime.After(cutoff) {
+			return nil
+		}
+		switch {
+		case validHash(name) && !known[name]:
+			orphans = append(orphans, GCEntry{Path: obj.Key, Reason: ReasonNotIndexed, Size: obj.Size})
+		case strings.HasPrefix(name, ".upload-") || strings.HasSuffix(name, ".tmp"):
+			orphans = append(orphans, GCEntry{Path: obj.Key, Reason: ReasonStaleUpload, Size: obj.Size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range orphans {
+		report.add(entry)
+		if dryRun {
+			continue
+		}
+		if err := bs.backend.Delete(ctx, entry.Path); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// unindex removes the metadata of the blob and its owner keys.
+func (bs *Store) unindex(meta *Meta) error {
+	return bs.db.Update(func(txn *badger.Txn) error {
+		for _, owner := range meta.Owners {
+			if err := txn.Delete([]byte("blobowner:" + owner + ":" + meta.SHA256)); err != nil {
+				return err
+			}
+		}
+		return deleteMeta(txn, meta)
+	})
+}
+
+// disown keeps only the owners in left, dropping the keys of the others.
+func (bs *Store) disown(sha256 string, left []string) error {
+	return bs.db.Update(func(txn *badger.Txn) error {
+		meta, err := getMeta(txn, sha256)
+		if err != nil || meta == nil {
+			return err
+		}
+		for _, owner := range meta.Owners {
+			if slices.Contains(left, owner) {
+				continue
+			}
+			if err := txn.Delete([]byte("blobowner:" + owner + ":" + sha256)); err != nil {
+				return err
+			}
+		}
+		meta.Owners = left
+		return setMeta(txn, meta)
+	})
+}
+
+// thumbnailsSize returns the bytes taken by the thumbnails of the blob.
+func (bs *Store) thumbnailsSize(ctx context.Context, sha256 string) int64 {
+	var size int64
+	for _, s := range bs.c.Images.ThumbnailSizes {
+		if obj, err := bs.backend.Stat(ctx, thumbnailKey(sha256, s)); err == nil {
+			size += obj.Size
+		}
+	}
+	return size
+}
+
+// StartGC runs GC every interval until ctx is done, logging what was removed.
+func (bs *Store) StartGC(ctx context.Context, interval time.Duration, gone func(pubkey string) bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := bs.GC(ctx, gone, false)
+			if err != nil {
+				log.Logger.Error("Failed to collect blobs", zap.Error(err))
+				continue
+			}
+			log.Logger.Debug("Collected blobs", zap.Int("count", len(report.Entries)), zap.Int64("bytes", report.ReclaimableBytes))
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package blob
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxImagePixels bounds the images decoded for processing, so a small file declaring huge
+// dimensions cannot exhaust memory.
+const maxImagePixels = 50_000_000
+
+// blurhashSize is the edge of the copy the blurhash is computed from; blurhashes only
+// describe a handful of color components, so a larger source adds nothing.
+const blurhashSize = 64
+
+// ImageConfig controls the processing of uploaded images.
+type ImageConfig struct {
+	// StripMetadata removes EXIF, XMP and text metadata (GPS position included) from
+	// JPEG, PNG and WebP uploads before they are stored.
+	StripMetadata bool
+	// ThumbnailSizes are the longest edges, in pixels, of the thumbnails generated for
+	// every image upload and served at /thumbs/<size>/<sha256>.
+	ThumbnailSizes []int
+}
+
+// StripMetadata returns body without the metadata of its format, which is detected from
+// the bytes. The image data itself is copied untouched; other formats are returned as is.
+func StripMetadata(body []byte) ([]byte, error) {
+	mimetype, _ := Sniff(body)
+	switch mimetype {
+	case "image/jpeg":
+		return stripJPEG(body)
+	case "image/png":
+		return stripPNG(body)
+	case "image/webp":
+		return stripWebP(body)
+	}
+	return body, nil
+}
+
+var errMalformedImage = errors.New("malformed image")
+
+// stripJPEG drops the APP1 (EXIF, XMP) and APP13 (IPTC) segments preceding the image data.
+func stripJPEG(body []byte) ([]byte, error) {
+	if len(body) < 4 || body[0] != 0xFF || body[1] != 0xD8 {
+		return nil, errMalformedImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	out.Write(body[:2])
+	i := 2
+	for {
+		if i+4 > len(body) || body[i] != 0xFF {
+			return nil, errMalformedImage
+		}
+		marker := body[i+1]
+		if marker == 0xDA {
+			// start of scan: the rest is entropy-coded image data
+			out.Write(body[i:])
+			return out.Bytes(), nil
+		}
+		length := int(binary.BigEndian.Uint16(body[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(body) {
+			return nil, errMalformedImage
+		}
+		if marker != 0xE1 && marker != 0xED {
+			out.Write(body[i:end])
+		}
+		i = end
+	}
+}
+
+// stripPNG drops the eXIf and textual (tEXt, zTXt, iTXt) chunks. Every chunk carries its
+// own CRC, so the remaining ones stay valid.
+func stripPNG(body []byte) ([]byte, error) {
+	const signature = 8
+	if len(body) < signature {
+		return nil, errMalformedImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	out.Write(body[:signature])
+	for i := signature; i < len(body); {
+		if i+12 > len(body) {
+			return nil, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(body[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(body) {
+			return nil, errMalformedImage
+		}
+		switch string(body[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+		default:
+			out.Write(body[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebP drops the EXIF and XMP chunks of an extended WebP, clearing their flags in
+// the VP8X header and fixing the RIFF size.
+func stripWebP(body []byte) ([]byte, error) {
+	const header = 12
+	if len(body) < header {
+		return nil, errMalformedImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(body)))
+	out.Write(body[:header])
+	for i := header; i < len(body); {
+		if i+8 > len(body) {
+			return nil, errMalformedImage
+		}
+		size := int(binary.LittleEndian.Uint32(body[i+4 : i+8]))
+		end := i + 8 + size + size%2
+		if end > len(body) {
+			if i+8+size != len(body) {
+				return nil, errMalformedImage
+			}
+			end = len(body)
+		}
+		switch fourcc := string(body[i : i+4]); fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := slices.Clone(body[i:end])
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(body[i:end])
+		}
+		i = end
+	}
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// ProcessImage is a StoreBlob hook recording the dimensions and blurhash of image uploads
+// in their metadata and generating their thumbnails. Anything it cannot decode is left alone.
+func (bs *Store) ProcessImage(ctx context.Context, hash string, body []byte) error {
+	img, err := decodeImage(body)
+	if err != nil {
+		return nil
+	}
+	bounds := img.Bounds()
+
+	var thumbs []int
+	for _, size := range bs.c.Images.ThumbnailSizes {
+		if size <= 0 || (bounds.Dx() <= size && bounds.Dy() <= size) {
+			continue
+		}
+		if err := bs.writeThumbnail(ctx, hash, size, resize(img, size)); err != nil {
+			return err
+		}
+		thumbs = append(thumbs, size)
+	}
+
+	hashImg := img
+	if bounds.Dx() > blurhashSize || bounds.Dy() > blurhashSize {
+		hashImg = resize(img, blurhashSize)
+	}
+	bh, err := blurhash.Encode(4, 3, hashImg)
+	if err != nil {
+		log.Logger.Warn("Failed to compute blurhash", zap.String("sha256", hash), zap.Error(err))
+	}
+
+	return bs.db.Update(func(txn *badger.Txn) error {
+		meta, err := getMeta(txn, hash)
+		if err != nil || meta == nil {
+			return err
+		}
+		meta.Width, meta.Height = bounds.Dx(), bounds.Dy()
+		meta.Blurhash = bh
+		meta.Thumbs = thumbs
+		return setMeta(txn, meta)
+	})
+}
+
+// decodeImage decodes the JPEG, PNG, GIF or WebP in body, refusing oversized images
+// before allocating their pixels.
+func decodeImage(body []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels not processed", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(body))
+	return img, err
+}
+
+// resize scales img down so that its longest edge is size pixels.
+func resize(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, b.Dy()*size/b.Dx())
+	} else {
+		w = max(1, b.Dx()*size/b.Dy())
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// thumbnailKey is where the thumbnail of the blob hash with the given size is kept,
+// sharded like the blobs themselves.
+func thumbnailKey(hash string, size int) string {
+	return "thumbs/" + strconv.Itoa(size) + "/" + blobKey(hash)
+}
+
+// writeThumbnail stores thumb as a JPEG, or as a PNG when it has transparent pixels.
+func (bs *Store) writeThumbnail(ctx context.Context, hash string, size int, thumb image.Image) error {
+	var buf bytes.Buffer
+	var err error
+	if opaque(thumb) {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return err
+	}
+	return bs.backend.Put(ctx, thumbnailKey(hash, size), buf.Bytes())
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// deleteThumbnails removes every thumbnail of the blob hash.
+func (bs *Store) deleteThumbnails(ctx context.Context, hash string) {
+	for _, size := range bs.c.Images.ThumbnailSizes {
+		if err := bs.backend.Delete(ctx, thumbnailKey(hash, size)); err != nil {
+			log.Logger.Warn("Failed to delete thumbnail", zap.String("sha256", hash), zap.Int("size", size), zap.Error(err))
+		}
+	}
+}
+
+// ThumbnailHandler serves GET /thumbs/<size>/<sha256>[.ext] from the generated thumbnails.
+func (bs *Store) ThumbnailHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawSize, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/thumbs/"), "/")
+		hash, _, _ := strings.Cut(file, ".")
+		size, err := strconv.Atoi(rawSize)
+		if err != nil || !validHash(hash) || !slices.Contains(bs.c.Images.ThumbnailSizes, size) {
+			http.NotFound(w, r)
+			return
+		}
+
+		f, err := bs.backend.Open(r.Context(), thumbnailKey(hash, size))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+		http.ServeContent(w, r, "", time.Time{}, f)
+	})
+}
+
+// ThumbnailURL returns where the thumbnail of meta with the given size is served.
+func (m *Meta) ThumbnailURL(serviceURL string, size int) string {
+	return serviceURL + "/thumbs/" + strconv.Itoa(size) + "/" + m.SHA256
+}
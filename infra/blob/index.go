@@ -0,0 +1,417 @@
+package blob
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// backfillKey marks that the descriptors kept as kind 24242 events by blossom's
+// EventStoreBlobIndexWrapper were moved into the index.
+const backfillKey = "blob-backfilled"
+
+// accessResolution is how stale LastAccess may get before a download refreshes it,
+// so serving a popular blob does not write to Badger on every request.
+const accessResolution = time.Hour
+
+// Meta is what the index knows about a stored blob.
+type Meta struct {
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+	Type   string `json:"type"`
+	// Ext is the extension the blob was uploaded with, including the dot.
+	Ext        string          `json:"ext"`
+	Uploaded   nostr.Timestamp `json:"uploaded"`
+	LastAccess nostr.Timestamp `json:"last_access"`
+	// Owners are the pubkeys that uploaded the blob; it is deleted once none is left.
+	Owners []string `json:"owners"`
+	// Width, Height and Blurhash are only known for images.
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Blurhash string `json:"blurhash,omitempty"`
+	// Thumbs are the sizes of the thumbnails generated for the blob.
+	Thumbs []int `json:"thumbs,omitempty"`
+	// Original is the sha256 of the file as uploaded, when stripping its metadata changed it.
+	Original string `json:"original,omitempty"`
+}
+
+// NIP94Tags returns the NIP-94 file metadata of m served from serviceURL, as used in
+// kind 1063 events and "imeta" tags.
+func (m *Meta) NIP94Tags(serviceURL string) nostr.Tags {
+	tags := nostr.Tags{
+		{"url", serviceURL + "/" + m.SHA256 + m.Ext},
+		{"x", m.SHA256},
+		{"ox", cmp.Or(m.Original, m.SHA256)},
+		{"size", strconv.Itoa(m.Size)},
+	}
+	if m.Type != "" {
+		tags = append(tags, nostr.Tag{"m", m.Type})
+	}
+	if m.Width > 0 && m.Height > 0 {
+		tags = append(tags, nostr.Tag{"dim", strconv.Itoa(m.Width) + "x" + strconv.Itoa(m.Height)})
+	}
+	if m.Blurhash != "" {
+		tags = append(tags, nostr.Tag{"blurhash", m.Blurhash})
+	}
+	if len(m.Thumbs) > 0 {
+		tags = append(tags, nostr.Tag{"thumb", m.ThumbnailURL(serviceURL, slices.Max(m.Thumbs))})
+	}
+	return tags
+}
+
+// Descriptor returns the BUD-02 blob descriptor of m served from serviceURL.
+func (m *Meta) Descriptor(serviceURL string) blossom.BlobDescriptor {
+	bd := blossom.BlobDescriptor{
+		URL:      serviceURL + "/" + m.SHA256 + m.Ext,
+		SHA256:   m.SHA256,
+		Size:     m.Size,
+		Type:     m.Type,
+		Uploaded: m.Uploaded,
+	}
+	if len(m.Owners) > 0 {
+		bd.Owner = m.Owners[0]
+	}
+	return bd
+}
+
+var _ blossom.BlobIndex = (*Store)(nil)
+
+// Keep records that pubkey uploaded blob, implementing blossom.BlobIndex. Metadata lives
+// in Badger as "blob:<sha256>", with one "blobowner:<pubkey>:<sha256>" key per owner holding
+// when its upload expires, and "blobox:<original sha256>" pointing to blobs whose metadata
+// was stripped. A blob pubkey does not own yet must fit in its quota.
+func (bs *Store) Keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string) error {
+	return bs.keep(ctx, blob, pubkey, true)
+}
+
+func (bs *Store) keep(ctx context.Context, blob blossom.BlobDescriptor, pubkey string, quota bool) error {
+	// Badger does not see parallel uploads of different blobs as conflicting, so the quota
+	// check and the new owner key are serialized here
+	bs.keepMu.Lock()
+	defer bs.keepMu.Unlock()
+	return bs.db.Update(func(txn *badger.Txn) error {
+		meta, err := getMeta(txn, blob.SHA256)
+		if err != nil {
+			return err
+		}
+		if meta == nil {
+			// backfilled blobs keep their upload time, but their idle time only starts
+			// counting now, or the first expiration would take every old blob at once
+			meta = &Meta{
+				SHA256:     blob.SHA256,
+				Size:       blob.Size,
+				Type:       blob.Type,
+				Ext:        extOf(blob.URL, blob.SHA256),
+				Uploaded:   blob.Uploaded,
+				LastAccess: nostr.Now(),
+			}
+		}
+		if original, ok := ctx.Value(originalKey{}).(string); ok && original != meta.SHA256 && meta.Original == "" {
+			meta.Original = original
+			if err := txn.Set([]byte("blobox:"+original), []byte(meta.SHA256)); err != nil {
+				return err
+			}
+		}
+		if !slices.Contains(meta.Owners, pubkey) {
+			if quota {
+				if err := bs.checkQuota(txn, pubkey, meta.Size); err != nil {
+					return err
+				}
+			}
+			meta.Owners = append(meta.Owners, pubkey)
+		}
+		if err := setOwner(txn, pubkey, blob.SHA256, bs.expiration(ctx, pubkey, meta.Type)); err != nil {
+			return err
+		}
+		return setMeta(txn, meta)
+	})
+}
+
+// List returns the descriptors of every blob owned by pubkey, implementing blossom.BlobIndex.
+func (bs *Store) List(ctx context.Context, pubkey string) (chan blossom.BlobDescriptor, error) {
+	metas, err := bs.Owned(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan blossom.BlobDescriptor)
+	go func() {
+		defer close(ch)
+		for _, meta := range metas {
+			select {
+			case ch <- meta.Descriptor(bs.c.ServiceURL):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Get returns the descriptor of the blob, or nil when it is not stored, implementing blossom.BlobIndex.
+// The original sha256 of a stripped upload finds the stored blob too.
+func (bs *Store) Get(ctx context.Context, sha256 string) (*blossom.BlobDescriptor, error) {
+	meta, err := bs.Resolve(sha256)
+	if err != nil || meta == nil {
+		return nil, err
+	}
+	bd := meta.Descriptor(bs.c.ServiceURL)
+	return &bd, nil
+}
+
+// Delete removes pubkey from the owners of the blob, implementing blossom.BlobIndex.
+// The metadata goes away with the last owner, which tells blossom to delete the file. When
+// sha256 is the original hash of a stripped upload, blossom would delete a file by that
+// name, so the stored blob is deleted here instead.
+func (bs *Store) Delete(ctx context.Context, sha256 string, pubkey string) error {
+	var orphan string
+	if err := bs.db.Update(func(txn *badger.Txn) error {
+		meta, err := resolve(txn, sha256)
+		if err != nil || meta == nil {
+			return err
+		}
+		if err := txn.Delete([]byte("blobowner:" + pubkey + ":" + meta.SHA256)); err != nil {
+			return err
+		}
+		meta.Owners = slices.DeleteFunc(meta.Owners, func(owner string) bool { return owner == pubkey })
+		if len(meta.Owners) == 0 {
+			if meta.SHA256 != sha256 {
+				orphan = meta.SHA256
+			}
+			return deleteMeta(txn, meta)
+		}
+		return setMeta(txn, meta)
+	}); err != nil {
+		return err
+	}
+	if orphan != "" {
+		return bs.DeleteBlob(ctx, orphan)
+	}
+	return nil
+}
+
+// Meta returns the metadata of the blob, or nil when it is not stored.
+func (bs *Store) Meta(sha256 string) (*Meta, error) {
+	var meta *Meta
+	err := bs.db.View(func(txn *badger.Txn) error {
+		var err error
+		meta, err = getMeta(txn, sha256)
+		return err
+	})
+	return meta, err
+}
+
+// Resolve returns the metadata of the blob named hash, or of the blob stored for an upload
+// whose original sha256 was hash; nil when neither is stored.
+func (bs *Store) Resolve(hash string) (*Meta, error) {
+	var meta *Meta
+	err := bs.db.View(func(txn *badger.Txn) error {
+		var err error
+		meta, err = resolve(txn, hash)
+		return err
+	})
+	return meta, err
+}
+
+func resolve(txn *badger.Txn, hash string) (*Meta, error) {
+	if meta, err := getMeta(txn, hash); err != nil || meta != nil {
+		return meta, err
+	}
+	item, err := txn.Get([]byte("blobox:" + hash))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var meta *Meta
+	err = item.Value(func(val []byte) error {
+		meta, err = getMeta(txn, string(val))
+		return err
+	})
+	return meta, err
+}
+
+type originalKey struct{}
+
+// withOriginal returns a context telling Keep that the blob kept within it was stored for an
+// upload whose sha256 was original, before its metadata was stripped.
+func withOriginal(ctx context.Context, original string) context.Context {
+	return context.WithValue(ctx, originalKey{}, original)
+}
+
+// Owned returns the metadata of every blob owned by pubkey.
+func (bs *Store) Owned(pubkey string) ([]*Meta, error) {
+	var metas []*Meta
+	err := bs.db.View(func(txn *badger.Txn) error {
+		var err error
+		metas, err = owned(txn, pubkey)
+		return err
+	})
+	return metas, err
+}
+
+func owned(txn *badger.Txn, pubkey string) ([]*Meta, error) {
+	var metas []*Meta
+	it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+	defer it.Close()
+
+	prefix := []byte("blobowner:" + pubkey + ":")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		meta, err := getMeta(txn, string(it.Item().Key()[len(prefix):]))
+		if err != nil {
+			return nil, err
+		}
+		if meta != nil {
+			metas = append(metas, meta)
+		}
+	}
+	return metas, nil
+}
+
+// Usage returns how many blobs pubkey owns and their total size in bytes.
+func (bs *Store) Usage(pubkey string) (count int, size int64, err error) {
+	metas, err := bs.Owned(pubkey)
+	for _, meta := range metas {
+		size += int64(meta.Size)
+	}
+	return len(metas), size, err
+}
+
+// touch refreshes the last access time of the blob when it is older than accessResolution.
+func (bs *Store) touch(sha256 string) error {
+	now := nostr.Now()
+	return bs.db.Update(func(txn *badger.Txn) error {
+		meta, err := getMeta(txn, sha256)
+		if err != nil || meta == nil || now.Time().Sub(meta.LastAccess.Time()) < accessResolution {
+			return err
+		}
+		meta.LastAccess = now
+		return setMeta(txn, meta)
+	})
+}
+
+// Backfill moves the descriptors that blossom's EventStoreBlobIndexWrapper kept as
+// unsigned kind 24242 events in store into the index, deleting those events.
+// It runs only once; later calls return immediately.
+func (bs *Store) Backfill(ctx context.Context, store eventstore.Store) (int, error) {
+	done := false
+	if err := bs.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(backfillKey))
+		done = err == nil
+		return nil
+	}); err != nil || done {
+		return 0, err
+	}
+
+	// a negentropy session lifts the store's query limit so every event is visited
+	ch, err := store.QueryEvents(eventstore.SetNegentropy(ctx), nostr.Filter{Kinds: []int{24242}})
+	if err != nil {
+		return 0, err
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+
+	count := 0
+	for _, evt := range events {
+		x := evt.Tags.GetFirst([]string{"x", ""})
+		if x == nil || !validHash((*x)[1]) {
+			continue
+		}
+		if ok, _ := evt.CheckSignature(); ok {
+			// signed authorization events were published by clients, not kept by the wrapper
+			continue
+		}
+		bd := blossom.BlobDescriptor{SHA256: (*x)[1], Uploaded: evt.CreatedAt}
+		if tag := evt.Tags.GetFirst([]string{"type", ""}); tag != nil {
+			bd.Type = (*tag)[1]
+			bd.URL = bs.c.ServiceURL + "/" + bd.SHA256 + extFor(bd.Type)
+		}
+		if tag := evt.Tags.GetFirst([]string{"size", ""}); tag != nil {
+			bd.Size, _ = strconv.Atoi((*tag)[1])
+		}
+		// blobs already stored are indexed whatever their owners' quotas
+		if err := bs.keep(ctx, bd, evt.PubKey, false); err != nil {
+			return count, err
+		}
+		if err := store.DeleteEvent(ctx, evt); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, bs.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(backfillKey), nil)
+	})
+}
+
+// extOf returns the extension of a blob URL ending in <sha256><ext>.
+func extOf(url, sha256 string) string {
+	if _, ext, ok := strings.Cut(url, sha256); ok {
+		return ext
+	}
+	return ""
+}
+
+// extFor returns the extension blossom gives uploads of mimetype.
+func extFor(mimetype string) string {
+	switch mimetype {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "video/mp4":
+		return ".mp4"
+	}
+	if exts, _ := mime.ExtensionsByType(mimetype); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+func getMeta(txn *badger.Txn, sha256 string) (*Meta, error) {
+	item, err := txn.Get([]byte("blob:" + sha256))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &Meta{}
+	return meta, item.Value(func(val []byte) error {
+		return json.Unmarshal(val, meta)
+	})
+}
+
+// deleteMeta removes the metadata of the blob along with the key of its original hash.
+func deleteMeta(txn *badger.Txn, meta *Meta) error {
+	if meta.Original != "" {
+		if err := txn.Delete([]byte("blobox:" + meta.Original)); err != nil {
+			return err
+		}
+	}
+	return txn.Delete([]byte("blob:" + meta.SHA256))
+}
+
+func setMeta(txn *badger.Txn, meta *Meta) error {
+	jdata, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte("blob:"+meta.SHA256), jdata)
+}
@@ -0,0 +1,339 @@
+package blob
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// MirrorConfig controls how BUD-04 mirror requests fetch blobs from other servers.
+type MirrorConfig struct {
+	// Proxy is the URL of an HTTP or SOCKS5 proxy the fetches go through
+	// (socks5://127.0.0.1:9050 for Tor); empty connects directly.
+	Proxy string
+	// Timeout bounds a whole fetch, body included.
+	Timeout time.Duration
+}
+
+// NewMirrorClient returns the HTTP client mirror fetches are made with. Without a proxy
+// it refuses to connect to loopback, private and link-local addresses, redirects included,
+// so mirror requests cannot reach the relay's own network; with one, the proxy decides.
+func NewMirrorClient(c MirrorConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	} else {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refuseInternal}
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+	}
+	return &http.Client{Transport: transport, Timeout: c.Timeout}, nil
+}
+
+var errInternalAddress = errors.New("refusing to connect to an internal address")
+
+// refuseInternal is a net.Dialer Control refusing the resolved addresses a public blob
+// server cannot have.
+func refuseInternal(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	addr := addrPort.Addr().Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() ||
+		addr.IsMulticast() || sharedAddressSpace.Contains(addr) {
+		return errInternalAddress
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), internal but not private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Uploads serves the BUD-04 mirror and BUD-06 upload preflight endpoints khatru's blossom
+// lacks, and the NIP-96 API, storing blobs through the same index, hooks and RejectUpload
+// policies as Blossom uploads.
+type Uploads struct {
+	bs     *Store
+	bl     *blossom.BlossomServer
+	client *http.Client
+}
+
+// NewUploads creates the extra upload endpoints of bl, fetching mirrored blobs with client.
+func (bs *Store) NewUploads(bl *blossom.BlossomServer, client *http.Client) *Uploads {
+	return &Uploads{bs: bs, bl: bl, client: client}
+}
+
+// Handler answers PUT /mirror, HEAD /upload and the NIP-96 API, passing other requests
+// on to next. It must wrap the relay, since blossom answers HEAD /upload itself.
+func (u *Uploads) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/mirror" && r.Method == http.MethodPut:
+			u.mirror(w, r)
+		case r.URL.Path == "/upload" && r.Method == http.MethodHead:
+			u.preflight(w, r)
+		case r.URL.Path == "/.well-known/nostr/nip96.json":
+			u.nip96Info(w, r)
+		case r.URL.Path == NIP96Path || strings.HasPrefix(r.URL.Path, NIP96Path+"/"):
+			u.nip96(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// preflight tells a client whether an upload described by the X-SHA-256, X-Content-Length
+// and X-Content-Type headers would be accepted, before it sends the bytes (BUD-06).
+func (u *Uploads) preflight(w http.ResponseWriter, r *http.Request) {
+	auth, err := readAuthorization(r, "upload")
+	if err != nil {
+		rejectUpload(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if hash := r.Header.Get("X-SHA-256"); hash != "" && !validHash(hash) {
+		rejectUpload(w, `invalid "X-SHA-256" header`, http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(r.Header.Get("X-Content-Length"))
+	if err != nil || size <= 0 {
+		rejectUpload(w, `missing or invalid "X-Content-Length" header`, http.StatusLengthRequired)
+		return
+	}
+	mimetype := baseType(r.Header.Get("X-Content-Type"))
+	if mimetype == "" {
+		rejectUpload(w, `missing "X-Content-Type" header`, http.StatusUnsupportedMediaType)
+		return
+	}
+	if !slices.Contains(u.bs.c.MimeAcceptable, mimetype) {
+		rejectUpload(w, "file type "+mimetype+" not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if reject, reason, code := u.rejectUpload(r.Context(), auth, size, extFor(mimetype)); reject {
+		rejectUpload(w, reason, code)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// mirror fetches the blob at the URL in the request body and stores it as if it had been
+// uploaded (BUD-04). The authorization must name the blob's sha256 in an "x" tag, and the
+// fetched bytes must match it; they are stored untouched so the hash is preserved.
+func (u *Uploads) mirror(w http.ResponseWriter, r *http.Request) {
+	auth, err := readAuthorization(r, "upload")
+	if err != nil {
+		rejectUpload(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	expiration, err := ParseExpiration(r.Header.Get("X-Expiration"))
+	if err != nil {
+		rejectUpload(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := WithExpiration(r.Context(), expiration)
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		rejectUpload(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	source, err := url.Parse(req.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		rejectUpload(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	x := auth.Tags.GetFirst([]string{"x", ""})
+	if x == nil || !validHash((*x)[1]) {
+		rejectUpload(w, `"Authorization" event must name the blob in an "x" tag`, http.StatusBadRequest)
+		return
+	}
+	hash := (*x)[1]
+
+	// a blob already stored only needs a new owner
+	meta, err := u.bs.Meta(hash)
+	if err != nil {
+		rejectUpload(w, "failed to query: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if meta != nil {
+		if !slices.Contains(meta.Owners, auth.PubKey) {
+			if reject, reason, code := u.rejectUpload(r.Context(), auth, meta.Size, meta.Ext); reject {
+				rejectUpload(w, reason, code)
+				return
+			}
+		}
+		u.keep(ctx, w, meta.Descriptor(u.bl.ServiceURL), auth.PubKey, nil)
+		return
+	}
+
+	body, code, err := u.fetch(r.Context(), source.String())
+	if err != nil {
+		rejectUpload(w, err.Error(), code)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != hash {
+		rejectUpload(w, "fetched blob does not match the sha256 of the \"x\" tag", http.StatusConflict)
+		return
+	}
+	mimetype, ext := Sniff(body)
+	if mimetype == "" || !slices.Contains(u.bs.c.MimeAcceptable, mimetype) {
+		rejectUpload(w, "file type not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if reject, reason, code := u.rejectUpload(r.Context(), auth, len(body), ext); reject {
+		rejectUpload(w, reason, code)
+		return
+	}
+
+	u.keep(ctx, w, blossom.BlobDescriptor{
+		URL:      u.bl.ServiceURL + "/" + hash + ext,
+		SHA256:   hash,
+		Size:     len(body),
+		Type:     mimetype,
+		Uploaded: nostr.Now(),
+	}, auth.PubKey, body)
+}
+
+// errFetch is all a client learns of a failed fetch, so mirror requests cannot be used to
+// probe what answers where; the cause is only logged.
+var errFetch = errors.New("could not fetch the blob")
+
+// fetch downloads source, refusing anything larger than MaxFileSize. The returned code
+// is the status to answer with when err is set.
+func (u *Uploads) fetch(ctx context.Context, source string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("invalid url")
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		log.Logger.Debug("Failed to mirror blob", zap.String("url", source), zap.Error(err))
+		return nil, http.StatusBadGateway, errFetch
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Logger.Debug("Failed to mirror blob", zap.String("url", source), zap.Int("status", resp.StatusCode))
+		return nil, http.StatusBadGateway, errFetch
+	}
+	if resp.ContentLength > int64(u.bs.c.MaxFileSize) {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("file too big")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(u.bs.c.MaxFileSize)+1))
+	if err != nil {
+		log.Logger.Debug("Failed to mirror blob", zap.String("url", source), zap.Error(err))
+		return nil, http.StatusBadGateway, errFetch
+	}
+	if len(body) > u.bs.c.MaxFileSize {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("file too big")
+	}
+	if len(body) == 0 {
+		return nil, http.StatusBadGateway, errors.New("fetched blob is empty")
+	}
+	return body, 0, nil
+}
+
+// rejectUpload runs blossom's RejectUpload policies.
+func (u *Uploads) rejectUpload(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+	for _, reject := range u.bl.RejectUpload {
+		if rejected, reason, code := reject(ctx, auth, size, ext); rejected {
+			return true, reason, code
+		}
+	}
+	return false, "", 0
+}
+
+// keep stores bd for pubkey, answering with the descriptor like an upload does.
+func (u *Uploads) keep(ctx context.Context, w http.ResponseWriter, bd blossom.BlobDescriptor, pubkey string, body []byte) {
+	if err := u.store(ctx, bd, pubkey, body); err != nil {
+		rejectUpload(w, "failed to save: "+err.Error(), saveStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bd)
+}
+
+// store records pubkey as an owner of bd and, for new blobs, runs blossom's StoreBlob
+// hooks on body.
+func (u *Uploads) store(ctx context.Context, bd blossom.BlobDescriptor, pubkey string, body []byte) error {
+	if err := u.bl.Store.Keep(ctx, bd, pubkey); err != nil {
+		return err
+	}
+	if body == nil {
+		return nil
+	}
+	for _, store := range u.bl.StoreBlob {
+		if err := store(ctx, bd.SHA256, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveStatus is the status answering a failure to store an upload.
+func saveStatus(err error) int {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// readAuthorization reads the BUD-01 authorization event of r, which must be a valid,
+// unexpired kind 24242 event with a "t" tag for action.
+func readAuthorization(r *http.Request, action string) (*nostr.Event, error) {
+	token, ok := bytes.CutPrefix([]byte(r.Header.Get("Authorization")), []byte("Nostr "))
+	if !ok {
+		return nil, errors.New(`missing "Authorization" header`)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(token))
+	if err != nil {
+		return nil, errors.New(`invalid "Authorization" header`)
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil || evt.Kind != 24242 || !evt.CheckID() {
+		return nil, errors.New(`invalid "Authorization" event`)
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, errors.New(`invalid "Authorization" event signature`)
+	}
+	expiration := evt.Tags.GetFirst([]string{"expiration", ""})
+	if expiration == nil {
+		return nil, errors.New(`missing "expiration" tag`)
+	}
+	if ts, _ := strconv.ParseInt((*expiration)[1], 10, 64); nostr.Timestamp(ts) < nostr.Now() {
+		return nil, errors.New(`"Authorization" event expired`)
+	}
+	if evt.Tags.GetFirst([]string{"t", action}) == nil {
+		return nil, errors.New(`invalid "Authorization" event "t" tag`)
+	}
+	return &evt, nil
+}
@@ -0,0 +1,206 @@
+package blob
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+const testSecretKey = "000000000000000000000000000000000000000000000000000000000000000c"
+
+// newTestStore returns a Store over an in-memory database and backend.
+func newTestStore(t *testing.T, maxFileSize int) *Store {
+	t.Helper()
+	log.Logger = zap.NewNop()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewBlobStore(db, &Config{
+		Backend:        NewMemoryBackend(),
+		ServiceURL:     "http://relay.test",
+		MimeAcceptable: []string{"image/png"},
+		ExtAcceptable:  []string{".png"},
+		MaxFileSize:    maxFileSize,
+	})
+}
+
+// newTestUploads returns the upload endpoints of bs, fetching mirrored blobs with client.
+func newTestUploads(bs *Store, client *http.Client) *Uploads {
+	bl := &blossom.BlossomServer{ServiceURL: bs.c.ServiceURL, Store: bs}
+	bl.StoreBlob = append(bl.StoreBlob, bs.StoreBlob)
+	bl.RejectUpload = append(bl.RejectUpload, bs.RejectUpload(func(*nostr.Event) bool { return true }))
+	return bs.NewUploads(bl, client)
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Hex(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// mirrorRequest is a PUT /mirror of source authorized for the blob hash.
+func mirrorRequest(t *testing.T, source, hash string) *http.Request {
+	t.Helper()
+	auth := nostr.Event{
+		Kind:      24242,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"t", "upload"},
+			{"x", hash},
+			{"expiration", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)},
+		},
+	}
+	if err := auth.Sign(testSecretKey); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]string{"url": source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/mirror", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+	return req
+}
+
+func TestMirror(t *testing.T) {
+	blob := testPNG(t)
+	big := append(testPNG(t), make([]byte, 4096)...)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blob.png":
+			w.Write(blob)
+		case "/big.png":
+			w.Write(big)
+		case "/secret":
+			http.Error(w, "internal admin page", http.StatusTeapot)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer source.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		hash   string
+		code   int
+		reason string
+	}{
+		{name: "stores the blob", path: "/blob.png", hash: sha256Hex(blob), code: http.StatusOK},
+		{name: "refuses a hash mismatch", path: "/blob.png", hash: sha256Hex(big), code: http.StatusConflict},
+		{name: "refuses an oversized body", path: "/big.png", hash: sha256Hex(big), code: http.StatusRequestEntityTooLarge},
+		{name: "hides the upstream status", path: "/secret", hash: sha256Hex(blob), code: http.StatusBadGateway, reason: errFetch.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := newTestStore(t, len(blob)+100)
+			u := newTestUploads(bs, source.Client())
+
+			w := httptest.NewRecorder()
+			u.Handler(http.NotFoundHandler()).ServeHTTP(w, mirrorRequest(t, source.URL+tt.path, tt.hash))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d (%s), want %d", w.Code, w.Header().Get("X-Reason"), tt.code)
+			}
+			if tt.reason != "" && w.Header().Get("X-Reason") != tt.reason {
+				t.Errorf("reason = %q, want %q", w.Header().Get("X-Reason"), tt.reason)
+			}
+
+			stored, err := bs.LoadBlob(context.Background(), tt.hash)
+			if tt.code != http.StatusOK {
+				if err == nil {
+					t.Error("rejected mirror stored a blob")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Error("stored blob differs from the mirrored one")
+			}
+			meta, err := bs.Meta(tt.hash)
+			if err != nil || meta == nil || len(meta.Owners) != 1 {
+				t.Errorf("meta = %+v, %v; want one owner", meta, err)
+			}
+		})
+	}
+}
+
+func TestMirrorRefusesInternalAddresses(t *testing.T) {
+	blob := testPNG(t)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	}))
+	defer source.Close()
+
+	client, err := NewMirrorClient(MirrorConfig{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newTestUploads(newTestStore(t, len(blob)), client)
+
+	for _, host := range []string{source.URL, strings.Replace(source.URL, "127.0.0.1", "localhost", 1)} {
+		w := httptest.NewRecorder()
+		u.Handler(http.NotFoundHandler()).ServeHTTP(w, mirrorRequest(t, host+"/blob.png", sha256Hex(blob)))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%s: status = %d, want %d", host, w.Code, http.StatusBadGateway)
+		}
+	}
+}
+
+func TestRefuseInternal(t *testing.T) {
+	for address, refused := range map[string]bool{
+		"127.0.0.1:80":          true,
+		"[::1]:80":              true,
+		"10.1.2.3:80":           true,
+		"192.168.0.1:443":       true,
+		"169.254.169.254:80":    true,
+		"[fe80::1]:80":          true,
+		"[fd00::1]:80":          true,
+		"[::ffff:127.0.0.1]:80": true,
+		"0.0.0.0:80":            true,
+		"100.64.0.1:80":         true,
+		"93.184.215.14:443":     false,
+		"[2606:4700::1]:443":    false,
+	} {
+		if err := refuseInternal("tcp", address, nil); (err != nil) != refused {
+			t.Errorf("refuseInternal(%s) = %v, want refused %v", address, err, refused)
+		}
+	}
+}
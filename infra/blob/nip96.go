@@ -0,0 +1,298 @@
+package blob
+
+import (
+	"SimpleNosrtRelay/infra/nip98"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip96"
+)
+
+// NIP96Path is where the NIP-96 API is served: uploads and listings on the path itself,
+// downloads and deletions on NIP96Path/<sha256>.
+const NIP96Path = "/n96"
+
+// nip96Info is the /.well-known/nostr/nip96.json document.
+type nip96Info struct {
+	APIURL        string               `json:"api_url"`
+	DownloadURL   string               `json:"download_url"`
+	SupportedNIPs []int                `json:"supported_nips"`
+	TOSURL        string               `json:"tos_url"`
+	ContentTypes  []string             `json:"content_types"`
+	Plans         map[string]nip96Plan `json:"plans"`
+}
+
+type nip96Plan struct {
+	Name                 string              `json:"name"`
+	IsNIP98Required      bool                `json:"is_nip98_required"`
+	MaxByteSize          int                 `json:"max_byte_size"`
+	FileExpiration       [2]int              `json:"file_expiration"`
+	MediaTransformations map[string][]string `json:"media_transformations,omitempty"`
+}
+
+// nip96File is an entry of a NIP-96 listing.
+type nip96File struct {
+	Tags      nostr.Tags      `json:"tags"`
+	Content   string          `json:"content"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+type nip96Status struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// nip96Info answers GET /.well-known/nostr/nip96.json. Files are downloaded from the
+// Blossom URLs, so download_url is the service URL itself.
+func (u *Uploads) nip96Info(w http.ResponseWriter, r *http.Request) {
+	plan := nip96Plan{
+		Name:            "default",
+		IsNIP98Required: true,
+		MaxByteSize:     u.bs.c.MaxFileSize,
+	}
+	if lifetime := u.bs.c.Retention.Longest; lifetime > 0 {
+		plan.FileExpiration = [2]int{0, int(math.Ceil(lifetime.Hours() / 24))}
+	}
+	if len(u.bs.c.Images.ThumbnailSizes) > 0 {
+		plan.MediaTransformations = map[string][]string{"image": {"thumbnail"}}
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeNIP96(w, http.StatusOK, nip96Info{
+		APIURL:        u.bl.ServiceURL + NIP96Path,
+		DownloadURL:   u.bl.ServiceURL,
+		SupportedNIPs: []int{94, 96, 98},
+		ContentTypes:  u.bs.c.MimeAcceptable,
+		Plans:         map[string]nip96Plan{"default": plan},
+	})
+}
+
+// nip96 dispatches the requests to the NIP-96 API.
+func (u *Uploads) nip96(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	file := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, NIP96Path), "/")
+	switch {
+	case file == "" && r.Method == http.MethodPost:
+		u.nip96Upload(w, r)
+	case file == "" && r.Method == http.MethodGet:
+		u.nip96List(w, r)
+	case file != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		u.nip96Download(w, r, file)
+	case file != "" && r.Method == http.MethodDelete:
+		u.nip96Delete(w, r, file)
+	default:
+		nip96Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// nip96Upload stores the "file" field of a multipart upload through the same checks,
+// hooks and RejectUpload policies as a Blossom upload, answering with its NIP-94 tags.
+func (u *Uploads) nip96Upload(w http.ResponseWriter, r *http.Request) {
+	// the form fields around the file take a few more bytes than the file itself; the
+	// whole body is read first so a signed "payload" tag can be checked
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(u.bs.c.MaxFileSize)+64<<10))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			nip96Error(w, "file too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		nip96Error(w, "failed to read upload body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	auth, err := nip98.Validate(r, raw)
+	if err != nil {
+		nip96Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		nip96Error(w, `missing "file" field`, http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	body, err := io.ReadAll(io.LimitReader(f, int64(u.bs.c.MaxFileSize)+1))
+	if err != nil {
+		nip96Error(w, "failed to read upload body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 {
+		nip96Error(w, "empty upload", http.StatusBadRequest)
+		return
+	}
+	if len(body) > u.bs.c.MaxFileSize {
+		nip96Error(w, "file too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	expiration, err := ParseExpiration(r.FormValue("expiration"))
+	if err != nil {
+		nip96Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	original := hex.EncodeToString(sum[:])
+	if payload := auth.Tags.GetFirst([]string{"payload", ""}); payload != nil && (*payload)[1] != original {
+		nip96Error(w, `"payload" tag does not match the file`, http.StatusBadRequest)
+		return
+	}
+
+	mimetype, ext := Sniff(body)
+	if mimetype == "" || !slices.Contains(u.bs.c.MimeAcceptable, mimetype) {
+		nip96Error(w, "file type not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if declared := baseType(r.FormValue("content_type")); declared != "" && declared != "application/octet-stream" && declared != mimetype {
+		nip96Error(w, "content is "+mimetype+", not "+declared, http.StatusUnsupportedMediaType)
+		return
+	}
+	if u.bs.c.Images.StripMetadata && r.FormValue("no_transform") != "true" {
+		if body, err = StripMetadata(body); err != nil {
+			nip96Error(w, "could not remove the metadata of this image: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if reject, reason, code := u.rejectUpload(r.Context(), auth, len(body), ext); reject {
+		nip96Error(w, reason, code)
+		return
+	}
+
+	sum = sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+	stored, err := u.bs.Meta(hash)
+	if err != nil {
+		nip96Error(w, "failed to query: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// a blob already stored only needs a new owner
+	data := body
+	if stored != nil {
+		data = nil
+	}
+	if err := u.store(withOriginal(WithExpiration(r.Context(), expiration), original), blossom.BlobDescriptor{
+		URL:      u.bl.ServiceURL + "/" + hash + ext,
+		SHA256:   hash,
+		Size:     len(body),
+		Type:     mimetype,
+		Uploaded: nostr.Now(),
+	}, auth.PubKey, data); err != nil {
+		nip96Error(w, "failed to save: "+err.Error(), saveStatus(err))
+		return
+	}
+	meta, err := u.bs.Meta(hash)
+	if err != nil || meta == nil {
+		nip96Error(w, "failed to save", http.StatusInternalServerError)
+		return
+	}
+	resp := nip96.UploadResponse{Status: "success", Message: "Upload successful."}
+	resp.Nip94Event.Tags = meta.NIP94Tags(u.bl.ServiceURL)
+	if alt := r.FormValue("alt"); alt != "" {
+		resp.Nip94Event.Tags = append(resp.Nip94Event.Tags, nostr.Tag{"alt", alt})
+	}
+	resp.Nip94Event.Content = r.FormValue("caption")
+	writeNIP96(w, http.StatusCreated, resp)
+}
+
+// nip96Download serves GET NIP96Path/<sha256>[.ext], the stored or the original hash.
+func (u *Uploads) nip96Download(w http.ResponseWriter, r *http.Request, file string) {
+	hash, _, _ := strings.Cut(file, ".")
+	meta, err := u.bs.Resolve(hash)
+	if err != nil || meta == nil {
+		nip96Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	reader, err := u.bs.LoadBlob(r.Context(), meta.SHA256)
+	if err != nil {
+		nip96Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", meta.Type)
+	w.Header().Set("Cache-Control", "public, max-age=604800, immutable")
+	http.ServeContent(w, r, "", meta.Uploaded.Time(), reader)
+}
+
+// nip96Delete drops the signer's ownership of the blob named by its stored or original
+// hash, deleting the file once nobody owns it.
+func (u *Uploads) nip96Delete(w http.ResponseWriter, r *http.Request, file string) {
+	auth, err := nip98.Validate(r, nil)
+	if err != nil {
+		nip96Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	hash, _, _ := strings.Cut(file, ".")
+	meta, err := u.bs.Resolve(hash)
+	if err != nil || meta == nil || !slices.Contains(meta.Owners, auth.PubKey) {
+		nip96Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	if err := u.bl.Store.Delete(r.Context(), meta.SHA256, auth.PubKey); err != nil {
+		nip96Error(w, "failed to delete: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bd, err := u.bl.Store.Get(r.Context(), meta.SHA256); err == nil && bd == nil {
+		for _, del := range u.bl.DeleteBlob {
+			if err := del(r.Context(), meta.SHA256); err != nil {
+				nip96Error(w, "failed to delete: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	writeNIP96(w, http.StatusOK, nip96Status{Status: "success", Message: "File deleted."})
+}
+
+// nip96List answers GET NIP96Path?page=<n>&count=<n> with the signer's files, newest first.
+func (u *Uploads) nip96List(w http.ResponseWriter, r *http.Request) {
+	auth, err := nip98.Validate(r, nil)
+	if err != nil {
+		nip96Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+	page, count = max(page, 0), min(cmp.Or(count, 10), 100)
+
+	metas, err := u.bs.Owned(auth.PubKey)
+	if err != nil {
+		nip96Error(w, "failed to query: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slices.SortFunc(metas, func(a, b *Meta) int { return cmp.Compare(b.Uploaded, a.Uploaded) })
+
+	files := []nip96File{}
+	for _, meta := range metas[min(page*count, len(metas)):min((page+1)*count, len(metas))] {
+		files = append(files, nip96File{Tags: meta.NIP94Tags(u.bl.ServiceURL), CreatedAt: meta.Uploaded})
+	}
+	writeNIP96(w, http.StatusOK, map[string]any{
+		"count": len(files),
+		"total": len(metas),
+		"page":  page,
+		"files": files,
+	})
+}
+
+func writeNIP96(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// nip96Error answers with a NIP-96 error body, and the reason in X-Reason like Blossom.
+func nip96Error(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("X-Reason", message)
+	writeNIP96(w, code, nip96Status{Status: "error", Message: message})
+}
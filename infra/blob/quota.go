@@ -0,0 +1,137 @@
+package blob
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// ErrQuotaExceeded is returned by Keep when the blob does not fit in the uploader's quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Usage is how much blob storage a pubkey uses out of its quota.
+// Limits of zero and missing remaining amounts mean unlimited.
+type Usage struct {
+	PubKey         string `json:"pubkey"`
+	Files          int    `json:"files"`
+	Bytes          int64  `json:"bytes"`
+	MaxFiles       int    `json:"max_files"`
+	MaxBytes       int64  `json:"max_bytes"`
+	RemainingFiles *int   `json:"remaining_files,omitempty"`
+	RemainingBytes *int64 `json:"remaining_bytes,omitempty"`
+}
+
+// UsageOf returns the storage used by pubkey along with its quota.
+func (bs *Store) UsageOf(pubkey string) (*Usage, error) {
+	files, size, err := bs.Usage(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	usage := &Usage{PubKey: pubkey, Files: files, Bytes: size}
+	if bs.Quota == nil {
+		return usage, nil
+	}
+	quota := bs.Quota(pubkey)
+	usage.MaxFiles, usage.MaxBytes = quota.Files, quota.Bytes
+	if quota.Files > 0 {
+		remaining := max(quota.Files-files, 0)
+		usage.RemainingFiles = &remaining
+	}
+	if quota.Bytes > 0 {
+		remaining := max(quota.Bytes-size, 0)
+		usage.RemainingBytes = &remaining
+	}
+	return usage, nil
+}
+
+// rejectOverQuota refuses an upload of size bytes that would take pubkey past its quota.
+func (bs *Store) rejectOverQuota(pubkey string, size int) (bool, string, int) {
+	usage, err := bs.UsageOf(pubkey)
+	if err != nil {
+		log.Logger.Error("Failed to compute blob usage", zap.String("pubkey", pubkey), zap.Error(err))
+		return true, "error: could not check your storage quota", 500
+	}
+	if usage.RemainingFiles != nil && *usage.RemainingFiles < 1 {
+		return true, fmt.Sprintf("quota exceeded: at most %d files", usage.MaxFiles), 413
+	}
+	if usage.RemainingBytes != nil && *usage.RemainingBytes < int64(size) {
+		return true, fmt.Sprintf("quota exceeded: %d of %d bytes left", *usage.RemainingBytes, usage.MaxBytes), 413
+	}
+	return false, "", 0
+}
+
+// ownsAny reports whether the pubkey of the upload authorization auth already owns a blob
+// named in its "x" tags, in which case the upload takes no extra space.
+func (bs *Store) ownsAny(auth *nostr.Event) bool {
+	for _, tag := range auth.Tags {
+		if len(tag) < 2 || tag[0] != "x" {
+			continue
+		}
+		if meta, err := bs.Meta(tag[1]); err == nil && meta != nil && slices.Contains(meta.Owners, auth.PubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuota fails with ErrQuotaExceeded when a new blob of size bytes would take pubkey past
+// its quota, counting what pubkey owns within txn.
+func (bs *Store) checkQuota(txn *badger.Txn, pubkey string, size int) error {
+	if bs.Quota == nil {
+		return nil
+	}
+	quota := bs.Quota(pubkey)
+	if quota.Files <= 0 && quota.Bytes <= 0 {
+		return nil
+	}
+	metas, err := owned(txn, pubkey)
+	if err != nil {
+		return err
+	}
+	if quota.Files > 0 && len(metas) >= quota.Files {
+		return fmt.Errorf("%w: at most %d files", ErrQuotaExceeded, quota.Files)
+	}
+	var used int64
+	for _, meta := range metas {
+		used += int64(meta.Size)
+	}
+	if quota.Bytes > 0 && used+int64(size) > quota.Bytes {
+		return fmt.Errorf("%w: %d of %d bytes left", ErrQuotaExceeded, max(quota.Bytes-used, 0), quota.Bytes)
+	}
+	return nil
+}
+
+// UsageHandler serves GET /usage/<pubkey> with the pubkey's Usage, so clients can show
+// the space left before uploading.
+func (bs *Store) UsageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pubkey := strings.TrimPrefix(r.URL.Path, "/usage/")
+		if !nostr.IsValidPublicKey(pubkey) {
+			http.Error(w, "invalid pubkey", http.StatusBadRequest)
+			return
+		}
+
+		usage, err := bs.UsageOf(pubkey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(usage); err != nil {
+			log.Logger.Error("Failed to encode blob usage", zap.Error(err))
+		}
+	})
+}
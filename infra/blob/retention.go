@@ -0,0 +1,176 @@
+package blob
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// RetentionConfig controls how long blobs are kept; zero durations keep them forever.
+type RetentionConfig struct {
+	// Longest is the longest lifetime any upload may get, zero being forever, advertised
+	// to NIP-96 clients.
+	Longest time.Duration
+	// MaxIdle deletes blobs nobody downloaded for this long.
+	MaxIdle time.Duration
+}
+
+// ownership is the value of a "blobowner:<pubkey>:<sha256>" key. Keys without a value,
+// like those written before retention existed, never expire.
+type ownership struct {
+	// Expiration is when the owner's upload expires; the blob goes with its last owner.
+	Expiration nostr.Timestamp `json:"expiration,omitempty"`
+}
+
+type expirationKey struct{}
+
+// WithExpiration returns a context asking that blobs kept within it expire at expiration.
+// Requests can only shorten the lifetime given by the retention policy.
+func WithExpiration(ctx context.Context, expiration nostr.Timestamp) context.Context {
+	return context.WithValue(ctx, expirationKey{}, expiration)
+}
+
+// ParseExpiration parses the expiration requested with an upload, a unix timestamp in the
+// future; empty means none.
+func ParseExpiration(raw string) (nostr.Timestamp, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || nostr.Timestamp(ts) <= nostr.Now() {
+		return 0, errors.New("expiration must be a unix timestamp in the future")
+	}
+	return nostr.Timestamp(ts), nil
+}
+
+// expiration returns when a blob of mimetype kept by pubkey expires: the end of its
+// lifetime under the retention policy, or the expiration requested in ctx when sooner.
+func (bs *Store) expiration(ctx context.Context, pubkey, mimetype string) nostr.Timestamp {
+	var expiration nostr.Timestamp
+	if bs.Lifetime != nil {
+		if lifetime := bs.Lifetime(pubkey, mimetype); lifetime > 0 {
+			expiration = nostr.Timestamp(time.Now().Add(lifetime).Unix())
+		}
+	}
+	if requested, ok := ctx.Value(expirationKey{}).(nostr.Timestamp); ok && requested > 0 {
+		if expiration == 0 || requested < expiration {
+			expiration = requested
+		}
+	}
+	return expiration
+}
+
+// setOwner writes the ownership key of pubkey on the blob sha256, expiring at expiration.
+func setOwner(txn *badger.Txn, pubkey, sha256 string, expiration nostr.Timestamp) error {
+	var value []byte
+	if expiration > 0 {
+		var err error
+		if value, err = json.Marshal(ownership{Expiration: expiration}); err != nil {
+			return err
+		}
+	}
+	return txn.Set([]byte("blobowner:"+pubkey+":"+sha256), value)
+}
+
+// Expire drops the ownerships that expired, deleting the blobs left without owners, and
+// deletes the blobs not downloaded within MaxIdle. It returns how many blobs were deleted.
+func (bs *Store) Expire(ctx context.Context) (int, error) {
+	now := nostr.Now()
+	type owned struct{ pubkey, sha256 string }
+	var expired []owned
+	var idle []*Meta
+	if err := bs.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte("blobowner:")})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if item.ValueSize() == 0 {
+				continue
+			}
+			var o ownership
+			if err := item.Value(func(val []byte) error { return json.Unmarshal(val, &o) }); err != nil {
+				return err
+			}
+			if o.Expiration == 0 || o.Expiration > now {
+				continue
+			}
+			pubkey, sha256, _ := strings.Cut(string(item.Key()[len("blobowner:"):]), ":")
+			expired = append(expired, owned{pubkey, sha256})
+		}
+
+		if bs.c.Retention.MaxIdle <= 0 {
+			return nil
+		}
+		it2 := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: []byte("blob:")})
+		defer it2.Close()
+		for it2.Rewind(); it2.Valid(); it2.Next() {
+			meta, err := getMeta(txn, string(it2.Item().Key()[len("blob:"):]))
+			if err != nil {
+				return err
+			}
+			if meta != nil && now.Time().Sub(meta.LastAccess.Time()) > bs.c.Retention.MaxIdle {
+				idle = append(idle, meta)
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, o := range expired {
+		if err := bs.Delete(ctx, o.sha256, o.pubkey); err != nil {
+			return deleted, err
+		}
+		if meta, err := bs.Meta(o.sha256); err != nil || meta != nil {
+			continue
+		}
+		if err := bs.DeleteBlob(ctx, o.sha256); err != nil {
+			log.Logger.Error("Failed to delete expired blob", zap.String("sha256", o.sha256), zap.Error(err))
+			continue
+		}
+		deleted++
+	}
+	for _, meta := range idle {
+		if current, err := bs.Meta(meta.SHA256); err != nil || current == nil {
+			continue
+		}
+		if err := bs.unindex(meta); err != nil {
+			return deleted, err
+		}
+		if err := bs.DeleteBlob(ctx, meta.SHA256); err != nil {
+			log.Logger.Error("Failed to delete idle blob", zap.String("sha256", meta.SHA256), zap.Error(err))
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// StartExpire runs Expire every interval until ctx is done.
+func (bs *Store) StartExpire(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := bs.Expire(ctx)
+			if err != nil {
+				log.Logger.Error("Failed to delete expired blobs", zap.Error(err))
+				continue
+			}
+			log.Logger.Debug("Deleted expired blobs", zap.Int("count", n))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config locates the bucket of an S3Backend.
+type S3Config struct {
+	// Endpoint is the host[:port] of the S3-compatible service, without scheme.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to every key and is required: the collector deletes objects
+	// under it that the index does not know, so nothing else may be stored there.
+	Prefix string
+	// Insecure talks plain HTTP, for local stand-ins like MinIO.
+	Insecure bool
+}
+
+// S3Backend keeps objects in a bucket of an S3-compatible object store.
+type S3Backend struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+var _ Backend = (*S3Backend)(nil)
+
+// ErrS3Prefix is returned by NewS3Backend for an empty prefix, which would make every
+// object in the bucket look like a blob.
+var ErrS3Prefix = errors.New("an S3 prefix is required, such as blobs/")
+
+// NewS3Backend connects to the bucket described by c, creating it when missing.
+func NewS3Backend(ctx context.Context, c S3Config) (*S3Backend, error) {
+	// "blobs" must not also list "blobs-old/..."
+	prefix := strings.Trim(c.Prefix, "/")
+	if prefix == "" {
+		return nil, ErrS3Prefix
+	}
+	prefix += "/"
+
+	client, err := minio.New(c.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.AccessKey, c.SecretKey, ""),
+		Secure: !c.Insecure,
+		Region: c.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.BucketExists(ctx, c.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach bucket %q: %w", c.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, c.Bucket, minio.MakeBucketOptions{Region: c.Region}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %q: %w", c.Bucket, err)
+		}
+	}
+	return &S3Backend{client: client, bucket: c.Bucket, prefix: prefix}, nil
+}
+
+// Put uploads body in a single request; S3 objects only appear once complete.
+func (sb *S3Backend) Put(ctx context.Context, key string, body []byte) error {
+	_, err := sb.client.PutObject(ctx, sb.bucket, sb.prefix+key, bytes.NewReader(body), int64(len(body)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// Open returns the object as a minio.Object, which fetches the ranges read from it.
+func (sb *S3Backend) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	obj, err := sb.client.GetObject(ctx, sb.bucket, sb.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, notExist("open", key, err)
+	}
+	// GetObject is lazy; Stat surfaces a missing object before anything is served
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, notExist("open", key, err)
+	}
+	return obj, nil
+}
+
+func (sb *S3Backend) Stat(ctx context.Context, key string) (Object, error) {
+	info, err := sb.client.StatObject(ctx, sb.bucket, sb.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		return Object{}, notExist("stat", key, err)
+	}
+	return Object{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (sb *S3Backend) Delete(ctx context.Context, key string) error {
+	return sb.client.RemoveObject(ctx, sb.bucket, sb.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (sb *S3Backend) Walk(ctx context.Context, fn func(Object) error) error {
+	// stops the listing when fn fails halfway
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for info := range sb.client.ListObjects(ctx, sb.bucket, minio.ListObjectsOptions{Prefix: sb.prefix, Recursive: true}) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(Object{Key: strings.TrimPrefix(info.Key, sb.prefix), Size: info.Size, ModTime: info.LastModified}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notExist turns the S3 "no such key" errors into fs.ErrNotExist.
+func notExist(op, key string, err error) error {
+	if resp := minio.ToErrorResponse(err); resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+	}
+	return err
+}
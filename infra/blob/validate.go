@@ -0,0 +1,120 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/liamg/magic"
+)
+
+// Sniff detects the type of body from its bytes, ignoring whatever the client declared.
+// It asks liamg/magic first and falls back to net/http's detection, which knows the
+// video containers magic misses. It returns "" when neither recognizes the content.
+func Sniff(body []byte) (mimetype, ext string) {
+	if ft, err := magic.Lookup(body); err == nil && ft.Extension != "" {
+		ext = "." + ft.Extension
+		mimetype = ft.MIME
+		if mimetype == "" {
+			mimetype = mime.TypeByExtension(ext)
+		}
+		if mimetype != "" {
+			return baseType(mimetype), ext
+		}
+	}
+
+	mimetype = baseType(http.DetectContentType(body))
+	if mimetype == "application/octet-stream" || strings.HasPrefix(mimetype, "text/") {
+		return "", ""
+	}
+	return mimetype, extFor(mimetype)
+}
+
+// baseType drops the parameters of a media type ("text/plain; charset=utf-8" -> "text/plain").
+func baseType(mimetype string) string {
+	if mt, _, err := mime.ParseMediaType(mimetype); err == nil {
+		return mt
+	}
+	return mimetype
+}
+
+// ValidateUploads wraps next, checking the body of every BUD-02 upload (PUT /upload) before
+// blossom sees it: the size must be within MaxFileSize, the type detected from the bytes
+// must be in MimeAcceptable and agree with the declared Content-Type. Accepted uploads have
+// their metadata stripped when configured, keeping the sent sha256 as the original hash, and
+// the expiration asked in X-Expiration attached, and are passed on to next with other requests.
+func (bs *Store) ValidateUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/upload" || r.Method != http.MethodPut {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expiration, err := ParseExpiration(r.Header.Get("X-Expiration"))
+		if err != nil {
+			rejectUpload(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(bs.c.MaxFileSize)))
+		if err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				rejectUpload(w, "file too big", http.StatusRequestEntityTooLarge)
+				return
+			}
+			rejectUpload(w, "failed to read upload body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) == 0 {
+			rejectUpload(w, "empty upload", http.StatusBadRequest)
+			return
+		}
+
+		mimetype, _ := Sniff(body)
+		if mimetype == "" {
+			rejectUpload(w, "could not detect the file type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if !slices.Contains(bs.c.MimeAcceptable, mimetype) {
+			rejectUpload(w, "file type "+mimetype+" not supported", http.StatusUnsupportedMediaType)
+			return
+		}
+		if declared := baseType(r.Header.Get("Content-Type")); declared != "" && declared != "application/octet-stream" && declared != mimetype {
+			rejectUpload(w, "content is "+mimetype+", not "+declared, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		ctx := WithExpiration(r.Context(), expiration)
+		if bs.c.Images.StripMetadata {
+			// the client knows the blob by the hash of what it sent, which its authorization
+			// names too, so that hash keeps finding the stripped blob
+			sum := sha256.Sum256(body)
+			ctx = withOriginal(ctx, hex.EncodeToString(sum[:]))
+			if body, err = StripMetadata(body); err != nil {
+				rejectUpload(w, "could not remove the metadata of this image: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// blossom trusts Content-Length for its own checks, so make it the real size
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		r.Header.Set("Content-Type", mimetype)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// rejectUpload answers like blossom does, with the reason in X-Reason.
+func rejectUpload(w http.ResponseWriter, reason string, code int) {
+	w.Header().Add("X-Reason", reason)
+	w.WriteHeader(code)
+}
@@ -0,0 +1,293 @@
+// Package community implements NIP-72 moderated communities: posts tagged to a community
+// (kind 34550) are accepted, but only served to clients querying that community once one
+// of its moderators has published a kind 4550 approval.
+package community
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// backfillKey marks that approvals and posts stored before the index existed were indexed.
+const backfillKey = "community-backfilled"
+
+// Moderation keeps approvals as "communityapproved:<community>:<post id>" and the
+// moderation queue as "communitypending:<community>:<post id>".
+type Moderation struct {
+	db    *badger.DB
+	store eventstore.Store
+}
+
+// New creates a Moderation on db, reading community definitions and posts from store.
+func New(db *badger.DB, store eventstore.Store) *Moderation {
+	return &Moderation{db: db, store: store}
+}
+
+// ParseAddress splits a community address ("34550:<pubkey>:<d>") into its author and identifier.
+func ParseAddress(addr string) (pubkey, d string, ok bool) {
+	parts := strings.SplitN(addr, ":", 3)
+	if len(parts) != 3 || parts[0] != "34550" || !nostr.IsValidPublicKey(parts[1]) || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// Communities returns the addresses of the communities evt is tagged to, through
+// "a" tags or NIP-22 root "A" tags.
+func Communities(evt *nostr.Event) []string {
+	var addrs []string
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || (tag[0] != "a" && tag[0] != "A") {
+			continue
+		}
+		if _, _, ok := ParseAddress(tag[1]); ok && !slices.Contains(addrs, tag[1]) {
+			addrs = append(addrs, tag[1])
+		}
+	}
+	return addrs
+}
+
+// isPost reports whether evt is subject to approval: anything tagged to a community
+// except the definitions and approvals themselves.
+func isPost(evt *nostr.Event) bool {
+	return evt.Kind != nostr.KindCommunityDefinition && evt.Kind != nostr.KindCommunityPostApproval
+}
+
+// Moderators returns the pubkeys allowed to approve posts in the community addr: its
+// author and every "p" tag marked "moderator" in its latest definition.
+func (c *Moderation) Moderators(ctx context.Context, addr string) ([]string, error) {
+	pubkey, d, ok := ParseAddress(addr)
+	if !ok {
+		return nil, errors.New("invalid community address")
+	}
+	ch, err := c.store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{nostr.KindCommunityDefinition},
+		Authors: []string{pubkey},
+		Tags:    nostr.TagMap{"d": []string{d}},
+		Limit:   1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	moderators := []string{pubkey}
+	for evt := range ch {
+		for _, tag := range evt.Tags {
+			if len(tag) >= 4 && tag[0] == "p" && tag[3] == "moderator" && !slices.Contains(moderators, tag[1]) {
+				moderators = append(moderators, tag[1])
+			}
+		}
+	}
+	return moderators, nil
+}
+
+// IsModerator reports whether pubkey may approve posts in the community addr.
+func (c *Moderation) IsModerator(ctx context.Context, addr, pubkey string) bool {
+	moderators, err := c.Moderators(ctx, addr)
+	return err == nil && slices.Contains(moderators, pubkey)
+}
+
+// RejectEvent is a policy refusing approvals not signed by a moderator of their community.
+func (c *Moderation) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if evt.Kind != nostr.KindCommunityPostApproval {
+		return false, ""
+	}
+	addrs := Communities(evt)
+	if len(addrs) == 0 {
+		return true, `invalid: approval must reference a community with an "a" tag`
+	}
+	if evt.Tags.GetFirst([]string{"e", ""}) == nil {
+		return true, `invalid: approval must reference the post with an "e" tag`
+	}
+	for _, addr := range addrs {
+		if !c.IsModerator(ctx, addr, evt.PubKey) {
+			return true, "restricted: only moderators of the community can approve posts"
+		}
+	}
+	return false, ""
+}
+
+// SaveEvent queues posts tagged to a community and moves approved ones out of the queue.
+func (c *Moderation) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	addrs := Communities(evt)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	return c.db.Update(func(txn *badger.Txn) error {
+		if evt.Kind == nostr.KindCommunityPostApproval {
+			for _, tag := range evt.Tags {
+				if len(tag) < 2 || tag[0] != "e" {
+					continue
+				}
+				for _, addr := range addrs {
+					if err := txn.Set(key("communityapproved", addr, tag[1]), nil); err != nil {
+						return err
+					}
+					if err := txn.Delete(key("communitypending", addr, tag[1])); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		if !isPost(evt) {
+			return nil
+		}
+
+		for _, addr := range addrs {
+			if _, err := txn.Get(key("communityapproved", addr, evt.ID)); err == nil {
+				continue
+			} else if !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			if err := txn.Set(key("communitypending", addr, evt.ID), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Approved reports whether the post id was approved in the community addr.
+func (c *Moderation) Approved(addr, id string) bool {
+	err := c.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key("communityapproved", addr, id))
+		return err
+	})
+	return err == nil
+}
+
+// Pending returns the posts of the community addr still waiting for an approval.
+func (c *Moderation) Pending(ctx context.Context, addr string) ([]*nostr.Event, error) {
+	var ids []string
+	prefix := []byte("communitypending:" + addr + ":")
+	if err := c.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			ids = append(ids, string(it.Item().Key()[len(prefix):]))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	posts := []*nostr.Event{}
+	if len(ids) == 0 {
+		return posts, nil
+	}
+	ch, err := c.store.QueryEvents(ctx, nostr.Filter{IDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	for evt := range ch {
+		posts = append(posts, evt)
+	}
+	return posts, nil
+}
+
+// QueryEvents wraps query, dropping unapproved posts from results when the filter asks
+// for a community by its "a" or "A" tag. Other queries, and internal ones (no websocket
+// connection in ctx), are left untouched.
+func (c *Moderation) QueryEvents(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		var queried []string
+		for _, name := range []string{"a", "A"} {
+			for _, addr := range filter.Tags[name] {
+				if _, _, ok := ParseAddress(addr); ok {
+					queried = append(queried, addr)
+				}
+			}
+		}
+
+		ch, err := query(ctx, filter)
+		if err != nil || ch == nil || len(queried) == 0 || khatru.GetConnection(ctx) == nil {
+			return ch, err
+		}
+
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for evt := range ch {
+				if !c.visible(evt, queried) {
+					continue
+				}
+				select {
+				case out <- evt:
+				case <-ctx.Done():
+					// keep draining ch so the underlying query can finish
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// visible reports whether evt may be served to a query for the communities in queried:
+// posts need an approval in at least one of the queried communities they are tagged to.
+func (c *Moderation) visible(evt *nostr.Event, queried []string) bool {
+	if !isPost(evt) {
+		return true
+	}
+	matched := false
+	for _, addr := range Communities(evt) {
+		if !slices.Contains(queried, addr) {
+			continue
+		}
+		if c.Approved(addr, evt.ID) {
+			return true
+		}
+		matched = true
+	}
+	return !matched
+}
+
+// Backfill indexes the approvals and the text notes and comments (kinds 1 and 1111)
+// stored before the index existed. It scans them only once; later calls return immediately.
+func (c *Moderation) Backfill(ctx context.Context) (int, error) {
+	done := false
+	if err := c.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(backfillKey))
+		done = err == nil
+		return nil
+	}); err != nil || done {
+		return 0, err
+	}
+
+	// approvals go first so that approved posts never enter the queue; a negentropy
+	// session lifts the store's query limit so every event is visited
+	count := 0
+	for _, kinds := range [][]int{{nostr.KindCommunityPostApproval}, {nostr.KindTextNote, nostr.KindComment}} {
+		ch, err := c.store.QueryEvents(eventstore.SetNegentropy(ctx), nostr.Filter{Kinds: kinds})
+		if err != nil {
+			return count, err
+		}
+		for evt := range ch {
+			if len(Communities(evt)) == 0 {
+				continue
+			}
+			if reject, _ := c.RejectEvent(ctx, evt); reject {
+				continue
+			}
+			if err := c.SaveEvent(ctx, evt); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(backfillKey), nil)
+	})
+}
+
+func key(prefix, addr, id string) []byte {
+	return []byte(prefix + ":" + addr + ":" + id)
+}
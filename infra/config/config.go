@@ -1,8 +1,16 @@
 package config
 
 import (
+	"SimpleNosrtRelay/infra/identity"
+	"context"
+	"fmt"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/spf13/viper"
 	"net/url"
+	"strings"
+	"time"
 )
 
 var Cfg *Config
@@ -10,7 +18,144 @@ var Cfg *Config
 type BlossomConfig struct {
 	Enabled      bool `mapstructure:"enabled"`
 	AuthRequired bool `mapstructure:"auth_required"`
+	// Quotas limits blob storage per pubkey, keyed by role name, "invited" for invited
+	// members and "default" for everyone else. The most generous applicable quota wins.
+	Quotas map[string]Quota `mapstructure:"quotas"`
+	Images ImagesConfig     `mapstructure:"images"`
+	Mirror MirrorConfig     `mapstructure:"mirror"`
+	// Retention limits how long blobs are kept.
+	Retention BlobRetentionConfig `mapstructure:"retention"`
+	Storage   BlobStorageConfig   `mapstructure:"storage"`
+	// GCInterval is how often unowned and orphaned blobs are collected; zero disables it.
+	GCInterval time.Duration `mapstructure:"gc_interval"`
 }
+
+// ImagesConfig controls the processing of uploaded images.
+type ImagesConfig struct {
+	// StripMetadata removes EXIF/XMP metadata, GPS position included, before storing.
+	StripMetadata bool `mapstructure:"strip_metadata"`
+	// ThumbnailSizes are the longest edges, in pixels, of the generated thumbnails.
+	ThumbnailSizes []int `mapstructure:"thumbnail_sizes"`
+}
+
+// BlobStorageConfig selects where the bytes of blobs are kept.
+type BlobStorageConfig struct {
+	// Backend is "local" (base_path/blobs), "s3" or "memory" (lost on restart).
+	Backend string   `mapstructure:"backend"`
+	S3      S3Config `mapstructure:"s3"`
+}
+
+// S3Config locates the bucket of the "s3" blob backend.
+type S3Config struct {
+	// Endpoint is the host[:port] of the S3-compatible service, without scheme.
+	Endpoint  string `mapstructure:"endpoint"`
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	// Prefix holds the relay's objects; the blob collector owns everything under it.
+	Prefix string `mapstructure:"prefix"`
+	// Insecure talks plain HTTP, for local stand-ins.
+	Insecure bool `mapstructure:"insecure"`
+}
+
+// BlobRetentionConfig limits how long blobs are kept; zero durations keep them forever.
+type BlobRetentionConfig struct {
+	// Default is how long an upload is kept.
+	Default time.Duration `mapstructure:"default"`
+	// Types replaces Default for a MIME type ("video/mp4") or a whole major type ("video/*").
+	Types map[string]time.Duration `mapstructure:"types"`
+	// Roles extends the lifetime of uploads by role holders, keyed like Quotas; the longest
+	// applicable lifetime wins.
+	Roles map[string]time.Duration `mapstructure:"roles"`
+	// MaxIdle deletes blobs nobody downloaded for this long.
+	MaxIdle time.Duration `mapstructure:"max_idle"`
+	// Interval is how often expired blobs are deleted.
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// Longest returns the longest lifetime any MIME type or role gives an upload, zero being
+// forever. Uploads by the owner, always kept forever, are left out.
+func (c BlobRetentionConfig) Longest() time.Duration {
+	if c.Default == 0 {
+		return 0
+	}
+	longest := c.Default
+	for _, lifetimes := range []map[string]time.Duration{c.Types, c.Roles} {
+		for _, d := range lifetimes {
+			if d == 0 {
+				return 0
+			}
+			longest = max(longest, d)
+		}
+	}
+	return longest
+}
+
+// MirrorConfig controls how BUD-04 mirror requests fetch blobs from other servers.
+type MirrorConfig struct {
+	// Proxy is an HTTP or SOCKS5 proxy URL for the fetches, such as socks5://127.0.0.1:9050 for Tor.
+	Proxy   string        `mapstructure:"proxy"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// Quota limits how much a pubkey may keep in blob storage; zero fields are unlimited.
+type Quota struct {
+	Bytes int64 `mapstructure:"bytes" json:"bytes"`
+	Files int   `mapstructure:"files" json:"files"`
+}
+
+// IdentityConfig selects how NIP-05 addresses used in place of pubkeys are resolved.
+type IdentityConfig struct {
+	// Resolver is "http" (query the address's domain) or "file" (read File).
+	Resolver string `mapstructure:"resolver"`
+	File     string `mapstructure:"file"`
+}
+
+// Nip05Config controls the /.well-known/nostr.json identity server.
+type Nip05Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Reserved names can only be claimed by the relay owner.
+	Reserved []string `mapstructure:"reserved"`
+}
+
+// TombstoneConfig controls how long NIP-09 deletions are remembered.
+type TombstoneConfig struct {
+	// MaxAge is how long a tombstone is kept; zero keeps them forever.
+	MaxAge time.Duration `mapstructure:"max_age"`
+}
+
+// ExpirationConfig controls the NIP-40 background purge.
+type ExpirationConfig struct {
+	// PurgeInterval is how often expired events are deleted.
+	PurgeInterval time.Duration `mapstructure:"purge_interval"`
+}
+
+// PowConfig sets the NIP-13 proof-of-work difficulty required to publish.
+type PowConfig struct {
+	// Default applies to kinds missing from Kinds; zero disables the requirement.
+	Default int `mapstructure:"default"`
+	// Kinds overrides Default per event kind.
+	Kinds map[int]int `mapstructure:"kinds"`
+	// Invited, when set, caps the difficulty required from invited members.
+	Invited *int `mapstructure:"invited"`
+	// Roles caps the difficulty required from holders of each role.
+	Roles map[string]int `mapstructure:"roles"`
+}
+
+// GroupsConfig enables NIP-29 groups hosted by this relay.
+type GroupsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// SecretKey (hex or nsec) signs the group metadata events; it is the relay's own key.
+	SecretKey string `mapstructure:"secret_key"`
+}
+
+// ReportsConfig controls the NIP-56 moderation queue.
+type ReportsConfig struct {
+	// HideThreshold is how many trusted reporters hide an event or pubkey; zero never hides.
+	HideThreshold int `mapstructure:"hide_threshold"`
+}
+
 type StreamConfig struct {
 	Relays  []string `mapstructure:"relays"`
 	Enabled bool     `mapstructure:"enabled"`
@@ -36,18 +181,57 @@ type Config struct {
 	Info         *Info `mapstructure:"info"`
 	Blossom      *BlossomConfig
 	Stream       *StreamConfig
+	Identity     *IdentityConfig
+	Nip05        *Nip05Config
+	Tombstones   *TombstoneConfig
+	Expiration   *ExpirationConfig
+	Pow          *PowConfig
+	Groups       *GroupsConfig
+	Reports      *ReportsConfig
 	AppEnv       string `mapstructure:"app_env"`
 	BasePath     string `mapstructure:"base_path"`
 	Negentropy   bool   `mapstructure:"negentropy"`
 	AuthRequired bool   `mapstructure:"auth_required"`
+	// Roles maps each role name to the permissions it grants.
+	Roles map[string][]string `mapstructure:"roles"`
+	// BlockedPubKeys may never write to the relay.
+	BlockedPubKeys []string `mapstructure:"blocked_pubkeys"`
+	// PrivateKinds are only served to their authenticated author or p-tagged recipients.
+	PrivateKinds []int `mapstructure:"private_kinds"`
 }
 type Info struct {
-	Name        string `mapstructure:"name"`
-	Description string `mapstructure:"description"`
-	PubKey      string `mapstructure:"pub_key"`
-	Contact     string `mapstructure:"contact"`
-	Url         string `mapstructure:"url"`
-	Icon        string `mapstructure:"icon"`
+	Name           string                   `mapstructure:"name"`
+	Description    string                   `mapstructure:"description"`
+	PubKey         string                   `mapstructure:"pub_key"`
+	Contact        string                   `mapstructure:"contact"`
+	Url            string                   `mapstructure:"url"`
+	Icon           string                   `mapstructure:"icon"`
+	Banner         string                   `mapstructure:"banner"`
+	PostingPolicy  string                   `mapstructure:"posting_policy"`
+	PaymentsURL    string                   `mapstructure:"payments_url"`
+	RelayCountries []string                 `mapstructure:"relay_countries"`
+	LanguageTags   []string                 `mapstructure:"language_tags"`
+	Tags           []string                 `mapstructure:"tags"`
+	Fees           *nip11.RelayFeesDocument `mapstructure:"fees"`
+	Retention      []Retention              `mapstructure:"retention"`
+}
+
+// Retention is a NIP-11 retention entry: how long (seconds) or how many events of the
+// given kinds (numbers or [start, end] ranges; all kinds when empty) are kept.
+type Retention struct {
+	Kinds []any  `mapstructure:"kinds" json:"kinds,omitempty"`
+	Time  *int64 `mapstructure:"time" json:"time,omitempty"`
+	Count *int   `mapstructure:"count" json:"count,omitempty"`
+}
+
+// DefaultRoles are the roles defined when the configuration has no "roles" section.
+var DefaultRoles = map[string][]string{
+	"admin":     {"write", "read", "upload", "invite", "ban", "manage-kinds", "delete-others"},
+	"moderator": {"write", "read", "upload", "ban", "delete-others"},
+	"member":    {"write", "read", "invite"},
+	"uploader":  {"write", "read", "upload"},
+	"reader":    {"read"},
+	"bouncer":   {"write", "read", "ban"},
 }
 
 func InitConfig() error {
@@ -65,7 +249,37 @@ func InitConfig() error {
 
 	viper.SetDefault("blossom.enabled", true)
 	viper.SetDefault("blossom.auth_required", false)
+	viper.SetDefault("blossom.images.strip_metadata", true)
+	viper.SetDefault("blossom.images.thumbnail_sizes", []int{256, 1024})
+	viper.SetDefault("blossom.gc_interval", "0s")
+	viper.SetDefault("blossom.mirror.timeout", "60s")
+	viper.SetDefault("blossom.retention.default", "0s")
+	viper.SetDefault("blossom.retention.max_idle", "0s")
+	viper.SetDefault("blossom.retention.interval", "1h")
+	viper.SetDefault("blossom.storage.backend", "local")
+	viper.SetDefault("blossom.storage.s3.region", "us-east-1")
+	viper.SetDefault("blossom.storage.s3.prefix", "blobs/")
+	viper.SetDefault("blossom.quotas", map[string]any{
+		"default":   map[string]any{"bytes": 10 << 20, "files": 100},
+		"invited":   map[string]any{"bytes": 100 << 20},
+		"member":    map[string]any{"bytes": 100 << 20},
+		"uploader":  map[string]any{"bytes": 1 << 30},
+		"moderator": map[string]any{"bytes": 1 << 30},
+		"admin":     map[string]any{},
+	})
 	viper.SetDefault("stream.enabled", false)
+	viper.SetDefault("identity.resolver", "http")
+	viper.SetDefault("tombstones.max_age", "0s")
+	viper.SetDefault("expiration.purge_interval", "10m")
+	viper.SetDefault("pow.default", 0)
+	viper.SetDefault("groups.enabled", false)
+	viper.SetDefault("reports.hide_threshold", 0)
+	viper.SetDefault("nip05.enabled", true)
+	viper.SetDefault("nip05.reserved", []string{"_", "admin", "administrator", "root", "relay", "support", "abuse"})
+	viper.SetDefault("private_kinds", []int{4, 1059, 1060, 10050})
+	viper.SetDefault("blocked_pubkeys", []string{"fa984bd7dbb282f07e16e7ae87b26a2a7b9b90b7246a44771f0cf5ae58018f52"})
+
+	viper.SetDefault("roles", DefaultRoles)
 
 	viper.SetConfigName("nrs")
 	viper.SetConfigType("yaml")
@@ -85,6 +299,53 @@ func InitConfig() error {
 		cfg.AppEnv = "production"
 	}
 
+	if err := cfg.normalizePubKeys(); err != nil {
+		return err
+	}
+	if err := cfg.normalizeSecretKeys(); err != nil {
+		return err
+	}
+
 	Cfg = cfg
 	return nil
 }
+
+// normalizePubKeys installs the configured NIP-05 resolver and rewrites every
+// configured pubkey (hex, npub, nprofile or NIP-05) as hex.
+func (c *Config) normalizePubKeys() error {
+	resolver, err := identity.NewResolver(c.Identity.Resolver, c.Identity.File)
+	if err != nil {
+		return err
+	}
+	identity.SetResolver(resolver)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if c.Info.PubKey != "" {
+		if c.Info.PubKey, err = identity.ParsePubKey(ctx, c.Info.PubKey); err != nil {
+			return fmt.Errorf("info.pub_key: %w", err)
+		}
+	}
+	if c.BlockedPubKeys, err = identity.ParsePubKeys(ctx, c.BlockedPubKeys); err != nil {
+		return fmt.Errorf("blocked_pubkeys: %w", err)
+	}
+	return nil
+}
+
+// normalizeSecretKeys rewrites configured secret keys given as nsec as hex.
+func (c *Config) normalizeSecretKeys() error {
+	sk := strings.TrimSpace(c.Groups.SecretKey)
+	if strings.HasPrefix(sk, "nsec1") {
+		_, value, err := nip19.Decode(sk)
+		if err != nil {
+			return fmt.Errorf("groups.secret_key: %w", err)
+		}
+		sk = value.(string)
+	}
+	if c.Groups.Enabled && !nostr.IsValid32ByteHex(sk) {
+		return fmt.Errorf("groups.secret_key: a valid secret key is required when groups are enabled")
+	}
+	c.Groups.SecretKey = sk
+	return nil
+}
@@ -0,0 +1,220 @@
+// Package expiration enforces NIP-40: expired events are refused on write, hidden from
+// queries and deleted in the background using an index ordered by expiration time.
+package expiration
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+	"go.uber.org/zap"
+)
+
+// prefix keys the index as "expiration:<zero-padded unix time>:<event id>", so iterating
+// from the prefix visits events in expiration order and stops at the first one still valid.
+const prefix = "expiration:"
+
+// backfillKey marks that events stored before the index existed were indexed.
+const backfillKey = "expiration-backfilled"
+
+// DeleteFunc matches the signature of khatru's DeleteEvent hooks.
+type DeleteFunc func(ctx context.Context, evt *nostr.Event) error
+
+// Index tracks when stored events expire.
+type Index struct {
+	db    *badger.DB
+	store eventstore.Store
+}
+
+// NewIndex creates an Index on db, loading expired events from store when purging.
+func NewIndex(db *badger.DB, store eventstore.Store) *Index {
+	return &Index{db: db, store: store}
+}
+
+// IsExpired reports whether evt carries an expiration tag in the past.
+func IsExpired(evt *nostr.Event) bool {
+	expiresAt := nip40.GetExpiration(evt.Tags)
+	return expiresAt != -1 && expiresAt <= nostr.Now()
+}
+
+// RejectEvent is a policy refusing events that already expired.
+func (x *Index) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if IsExpired(evt) {
+		return true, "invalid: event has expired"
+	}
+	return false, ""
+}
+
+// SaveEvent indexes evt when it carries an expiration tag. It is meant for the
+// StoreEvent and ReplaceEvent hooks, after the event store.
+func (x *Index) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	expiresAt := nip40.GetExpiration(evt.Tags)
+	if expiresAt == -1 {
+		return nil
+	}
+	return x.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(indexKey(expiresAt, evt.ID), nil)
+	})
+}
+
+// QueryEvents wraps query, dropping events that expired but were not purged yet.
+//
+// khatru starts its own NIP-40 manager with every relay, which cannot be turned off and,
+// an hour in, loads every stored event with an empty filter to find expiring ones. The
+// Index replaces it, so that internal empty query (no connection in ctx; clients'
+// empty filters are refused earlier) gets no events and the manager only ever sees the
+// events stored while running, which it deletes the same way the purge would.
+func (x *Index) QueryEvents(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if khatru.GetConnection(ctx) == nil && nostr.FilterEqual(filter, nostr.Filter{}) {
+			ch := make(chan *nostr.Event)
+			close(ch)
+			return ch, nil
+		}
+		ch, err := query(ctx, filter)
+		if err != nil || ch == nil {
+			return ch, err
+		}
+
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for evt := range ch {
+				if IsExpired(evt) {
+					continue
+				}
+				select {
+				case out <- evt:
+				case <-ctx.Done():
+					// keep draining ch so the underlying query can finish
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// Backfill indexes the expiring events stored before the index existed. It scans the
+// database only once; later calls return immediately.
+func (x *Index) Backfill(ctx context.Context) (int, error) {
+	done := false
+	if err := x.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(backfillKey))
+		done = err == nil
+		return nil
+	}); err != nil || done {
+		return 0, err
+	}
+
+	// a negentropy session lifts the store's query limit so every event is visited
+	ch, err := x.store.QueryEvents(eventstore.SetNegentropy(ctx), nostr.Filter{})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for evt := range ch {
+		if nip40.GetExpiration(evt.Tags) == -1 {
+			continue
+		}
+		if err := x.SaveEvent(ctx, evt); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, x.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(backfillKey), nil)
+	})
+}
+
+// Purge deletes every event that expired by now through the given delete functions
+// and returns how many were removed.
+func (x *Index) Purge(ctx context.Context, deleters ...DeleteFunc) (int, error) {
+	var expired [][]byte
+	end := []byte(fmt.Sprintf("%s%020d:", prefix, nostr.Now()+1))
+	err := x.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if string(key) >= string(end) {
+				break
+			}
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range expired {
+		if len(key) < len(prefix)+64 {
+			continue
+		}
+		id := string(key[len(key)-64:])
+		if _, err := hex.DecodeString(id); err != nil {
+			continue
+		}
+
+		ch, err := x.store.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+		if err != nil {
+			return count, err
+		}
+		for evt := range ch {
+			// a replaced or re-signed event may no longer expire at the indexed time
+			if !IsExpired(evt) {
+				continue
+			}
+			for _, del := range deleters {
+				if err := del(ctx, evt); err != nil {
+					log.Logger.Error("Failed to delete expired event", zap.String("ID", evt.ID), zap.Error(err))
+				}
+			}
+			count++
+		}
+
+		if err := x.db.Update(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		}); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// StartPurge purges expired events every interval until ctx is done.
+func (x *Index) StartPurge(ctx context.Context, interval time.Duration, deleters ...DeleteFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := x.Purge(ctx, deleters...)
+			if err != nil {
+				log.Logger.Error("Failed to purge expired events", zap.Error(err))
+				continue
+			}
+			if n > 0 {
+				log.Logger.Debug("Purged expired events", zap.Int("count", n))
+			}
+		}
+	}
+}
+
+func indexKey(expiresAt nostr.Timestamp, id string) []byte {
+	return []byte(prefix + fmt.Sprintf("%020d", expiresAt) + ":" + id)
+}
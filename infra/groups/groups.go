@@ -0,0 +1,497 @@
+// Package groups hosts NIP-29 relay-based groups. Membership and metadata live in the
+// Manager; moderation events sent by group admins are applied after they are stored, and
+// the relay publishes the resulting group state (kinds 39000-39003) signed with its own key.
+package groups
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// Group roles, listed in the kind 39003 event of every group.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// roleKinds lists the moderation kinds each group role may publish.
+var roleKinds = map[string][]int{
+	RoleAdmin: {
+		nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+		nostr.KindSimpleGroupEditMetadata,
+		nostr.KindSimpleGroupDeleteEvent,
+		nostr.KindSimpleGroupDeleteGroup,
+		nostr.KindSimpleGroupCreateInvite,
+	},
+	RoleModerator: {
+		nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+		nostr.KindSimpleGroupDeleteEvent,
+	},
+}
+
+var roleDescriptions = map[string]string{
+	RoleAdmin:     "manages members, metadata, invites and the group itself",
+	RoleModerator: "adds and removes members without roles and deletes events",
+}
+
+// Groups enforces and applies NIP-29 for the groups hosted here.
+type Groups struct {
+	m     *manager.Manager
+	store eventstore.Store
+	sk    string
+	pk    string
+
+	mu   sync.Mutex
+	last nostr.Timestamp
+
+	// Publish stores and broadcasts the group state events signed by the relay.
+	Publish func(ctx context.Context, evt *nostr.Event) error
+	// DeleteEvent removes events deleted by moderators or along with their group.
+	DeleteEvent []func(ctx context.Context, evt *nostr.Event) error
+}
+
+// New creates Groups keeping membership in m, finding group events in store and
+// signing group state with the relay secret key sk.
+func New(m *manager.Manager, store eventstore.Store, sk string) (*Groups, error) {
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	return &Groups{m: m, store: store, sk: sk, pk: pk}, nil
+}
+
+// PubKey returns the relay key signing group state.
+func (g *Groups) PubKey() string {
+	return g.pk
+}
+
+// GroupID returns the group evt was sent to, from its "h" tag.
+func GroupID(evt *nostr.Event) string {
+	if tag := evt.Tags.GetFirst([]string{"h", ""}); tag != nil {
+		return (*tag)[1]
+	}
+	return ""
+}
+
+func isState(kind int) bool {
+	return kind >= nostr.KindSimpleGroupMetadata && kind <= nostr.KindSimpleGroupRoles
+}
+
+func isModeration(kind int) bool {
+	return kind >= nostr.KindSimpleGroupPutUser && kind <= 9020
+}
+
+// RejectEvent enforces who may write to each group.
+func (g *Groups) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if isState(evt.Kind) {
+		if evt.PubKey != g.pk {
+			return true, "blocked: group state is only published by the relay"
+		}
+		return false, ""
+	}
+
+	id := GroupID(evt)
+	if id == "" {
+		if isModeration(evt.Kind) || evt.Kind == nostr.KindSimpleGroupJoinRequest || evt.Kind == nostr.KindSimpleGroupLeaveRequest {
+			return true, `invalid: missing group "h" tag`
+		}
+		return false, ""
+	}
+
+	if evt.Kind == nostr.KindSimpleGroupCreateGroup {
+		if !manager.ValidGroupID(id) {
+			return true, "invalid: group ids may only contain a-z, 0-9, - and _"
+		}
+		if _, err := g.m.Group(id); err == nil {
+			return true, "duplicate: group already exists"
+		}
+		if err := g.m.CheckAccess(evt.PubKey); err != nil {
+			return true, "restricted: only relay members can create groups"
+		}
+		return false, ""
+	}
+
+	if _, err := g.m.Group(id); err != nil {
+		return true, "invalid: group not found"
+	}
+	roles, member := g.m.GroupRoles(id, evt.PubKey)
+	switch {
+	case evt.Kind == nostr.KindSimpleGroupJoinRequest:
+		if member {
+			return true, "duplicate: already a member of this group"
+		}
+	case evt.Kind == nostr.KindSimpleGroupLeaveRequest:
+		if !member {
+			return true, "invalid: not a member of this group"
+		}
+	case isModeration(evt.Kind):
+		if !g.can(evt.PubKey, roles, evt.Kind) {
+			return true, "restricted: your group role does not allow this action"
+		}
+		if !g.canManageRoles(evt.PubKey, roles) && g.changesRoles(id, evt) {
+			return true, "restricted: only group admins can grant or revoke group roles"
+		}
+	default:
+		if !member {
+			return true, "restricted: only group members can write to this group"
+		}
+	}
+	return false, ""
+}
+
+// can reports whether pubkey, holding roles in a group, may publish a moderation event of kind.
+// The relay owner moderates every group.
+func (g *Groups) can(pubkey string, roles []string, kind int) bool {
+	if g.m.HasRole(pubkey, manager.RoleOwner) {
+		return true
+	}
+	for _, role := range roles {
+		if slices.Contains(roleKinds[role], kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// canManageRoles reports whether pubkey, holding roles in a group, may grant and revoke group
+// roles: group admins and the relay owner.
+func (g *Groups) canManageRoles(pubkey string, roles []string) bool {
+	return slices.Contains(roles, RoleAdmin) || g.m.HasRole(pubkey, manager.RoleOwner)
+}
+
+// changesRoles reports whether the put-user or remove-user event evt would grant a role or
+// take one away from a member of group id. Moderators may only add and remove plain members.
+func (g *Groups) changesRoles(id string, evt *nostr.Event) bool {
+	if evt.Kind != nostr.KindSimpleGroupPutUser && evt.Kind != nostr.KindSimpleGroupRemoveUser {
+		return false
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		if evt.Kind == nostr.KindSimpleGroupPutUser && slices.ContainsFunc(tag[2:], func(role string) bool { return role != "" }) {
+			return true
+		}
+		if current, _ := g.m.GroupRoles(id, tag[1]); len(current) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveEvent applies moderation, join and leave events once they are stored.
+func (g *Groups) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	id := GroupID(evt)
+	if id == "" {
+		return nil
+	}
+	// group state must be updated even if the client disconnects
+	ctx = context.WithoutCancel(ctx)
+
+	switch evt.Kind {
+	case nostr.KindSimpleGroupCreateGroup:
+		group := manager.Group{ID: id, CreatedAt: evt.CreatedAt}
+		applyMetadata(&group, evt.Tags)
+		if err := g.m.SaveGroup(group); err != nil {
+			return err
+		}
+		if err := g.m.SetGroupMember(id, evt.PubKey, []string{RoleAdmin}); err != nil {
+			return err
+		}
+		return g.publishState(ctx, id, nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers, nostr.KindSimpleGroupRoles)
+
+	case nostr.KindSimpleGroupEditMetadata:
+		group, err := g.m.Group(id)
+		if err != nil {
+			return err
+		}
+		applyMetadata(group, evt.Tags)
+		if err := g.m.SaveGroup(*group); err != nil {
+			return err
+		}
+		return g.publishState(ctx, id, nostr.KindSimpleGroupMetadata)
+
+	case nostr.KindSimpleGroupPutUser:
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 || tag[0] != "p" || !nostr.IsValidPublicKey(tag[1]) {
+				continue
+			}
+			var roles []string
+			for _, role := range tag[2:] {
+				if _, ok := roleKinds[role]; ok {
+					roles = append(roles, role)
+				}
+			}
+			if err := g.m.SetGroupMember(id, tag[1], roles); err != nil {
+				return err
+			}
+		}
+		return g.publishState(ctx, id, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers)
+
+	case nostr.KindSimpleGroupRemoveUser:
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 || tag[0] != "p" {
+				continue
+			}
+			if err := g.m.RemoveGroupMember(id, tag[1]); err != nil {
+				return err
+			}
+		}
+		return g.publishState(ctx, id, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers)
+
+	case nostr.KindSimpleGroupDeleteEvent:
+		var ids []string
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "e" {
+				ids = append(ids, tag[1])
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		return g.deleteEvents(ctx, nostr.Filter{IDs: ids, Tags: nostr.TagMap{"h": []string{id}}})
+
+	case nostr.KindSimpleGroupDeleteGroup:
+		if err := g.deleteEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"h": []string{id}}}); err != nil {
+			return err
+		}
+		if err := g.deleteEvents(ctx, nostr.Filter{
+			Kinds:   []int{nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers, nostr.KindSimpleGroupRoles},
+			Authors: []string{g.pk},
+			Tags:    nostr.TagMap{"d": []string{id}},
+		}); err != nil {
+			return err
+		}
+		return g.m.DeleteGroup(id)
+
+	case nostr.KindSimpleGroupCreateInvite:
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "code" && tag[1] != "" {
+				if err := g.m.AddGroupInvite(id, tag[1]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+
+	case nostr.KindSimpleGroupJoinRequest:
+		group, err := g.m.Group(id)
+		if err != nil {
+			return err
+		}
+		code := evt.Tags.GetFirst([]string{"code", ""})
+		if group.Closed && (code == nil || !g.m.HasGroupInvite(id, (*code)[1])) {
+			// left for an admin to approve with a put-user event
+			return nil
+		}
+		if err := g.m.SetGroupMember(id, evt.PubKey, nil); err != nil {
+			return err
+		}
+		return g.publishState(ctx, id, nostr.KindSimpleGroupMembers)
+
+	case nostr.KindSimpleGroupLeaveRequest:
+		if err := g.m.RemoveGroupMember(id, evt.PubKey); err != nil {
+			return err
+		}
+		return g.publishState(ctx, id, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers)
+	}
+	return nil
+}
+
+// applyMetadata updates group from the tags of a create-group or edit-metadata event.
+func applyMetadata(group *manager.Group, tags nostr.Tags) {
+	for _, tag := range tags {
+		switch {
+		case len(tag) >= 2 && tag[0] == "name":
+			group.Name = tag[1]
+		case len(tag) >= 2 && tag[0] == "about":
+			group.About = tag[1]
+		case len(tag) >= 2 && tag[0] == "picture":
+			group.Picture = tag[1]
+		case len(tag) >= 1 && tag[0] == "private":
+			group.Private = true
+		case len(tag) >= 1 && tag[0] == "public":
+			group.Private = false
+		case len(tag) >= 1 && tag[0] == "closed":
+			group.Closed = true
+		case len(tag) >= 1 && tag[0] == "open":
+			group.Closed = false
+		}
+	}
+}
+
+func (g *Groups) deleteEvents(ctx context.Context, filter nostr.Filter) error {
+	// a negentropy session lifts the store's query limit so every event is visited
+	ch, err := g.store.QueryEvents(eventstore.SetNegentropy(ctx), filter)
+	if err != nil {
+		return err
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	for _, evt := range events {
+		for _, del := range g.DeleteEvent {
+			if err := del(ctx, evt); err != nil {
+				log.Logger.Error("Failed to delete group event", zap.String("ID", evt.ID), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// publishState signs and publishes the given state kinds of the group id.
+func (g *Groups) publishState(ctx context.Context, id string, kinds ...int) error {
+	group, err := g.m.Group(id)
+	if err != nil {
+		return err
+	}
+	members, err := g.m.GroupMembers(id)
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range kinds {
+		evt := &nostr.Event{Kind: kind, CreatedAt: g.nextTimestamp(), Tags: nostr.Tags{{"d", id}}}
+		switch kind {
+		case nostr.KindSimpleGroupMetadata:
+			evt.Tags = append(evt.Tags, nostr.Tag{"name", group.Name})
+			if group.About != "" {
+				evt.Tags = append(evt.Tags, nostr.Tag{"about", group.About})
+			}
+			if group.Picture != "" {
+				evt.Tags = append(evt.Tags, nostr.Tag{"picture", group.Picture})
+			}
+			if group.Private {
+				evt.Tags = append(evt.Tags, nostr.Tag{"private"})
+			} else {
+				evt.Tags = append(evt.Tags, nostr.Tag{"public"})
+			}
+			if group.Closed {
+				evt.Tags = append(evt.Tags, nostr.Tag{"closed"})
+			} else {
+				evt.Tags = append(evt.Tags, nostr.Tag{"open"})
+			}
+		case nostr.KindSimpleGroupAdmins:
+			for pubkey, roles := range members {
+				if len(roles) > 0 {
+					evt.Tags = append(evt.Tags, append(nostr.Tag{"p", pubkey}, roles...))
+				}
+			}
+		case nostr.KindSimpleGroupMembers:
+			for pubkey := range members {
+				evt.Tags = append(evt.Tags, nostr.Tag{"p", pubkey})
+			}
+		case nostr.KindSimpleGroupRoles:
+			for _, role := range []string{RoleAdmin, RoleModerator} {
+				evt.Tags = append(evt.Tags, nostr.Tag{"role", role, roleDescriptions[role]})
+			}
+		}
+		if err := evt.Sign(g.sk); err != nil {
+			return err
+		}
+		if err := g.Publish(ctx, evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextTimestamp returns now, or one second after the previous state event, so a state
+// published twice within a second still replaces the earlier version.
+func (g *Groups) nextTimestamp() nostr.Timestamp {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ts := nostr.Now()
+	if ts <= g.last {
+		ts = g.last + 1
+	}
+	g.last = ts
+	return ts
+}
+
+// CanRead reports whether pubkey may read evt: events of private groups are only
+// visible to their members and the relay owner.
+func (g *Groups) CanRead(pubkey string, evt *nostr.Event) bool {
+	id := GroupID(evt)
+	if id == "" {
+		return true
+	}
+	group, err := g.m.Group(id)
+	if err != nil || !group.Private {
+		return true
+	}
+	return g.isMember(id, pubkey)
+}
+
+func (g *Groups) isMember(id, pubkey string) bool {
+	if pubkey == "" {
+		return false
+	}
+	if _, member := g.m.GroupRoles(id, pubkey); member {
+		return true
+	}
+	return g.m.HasRole(pubkey, manager.RoleOwner)
+}
+
+// RejectFilter asks for authentication, or refuses, filters addressing private groups
+// the connection is not a member of.
+func (g *Groups) RejectFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	authed := khatru.GetAuthed(ctx)
+	for _, id := range filter.Tags["h"] {
+		group, err := g.m.Group(id)
+		if err != nil || !group.Private {
+			continue
+		}
+		if authed == "" {
+			return true, "auth-required: this group is private"
+		}
+		if !g.isMember(id, authed) {
+			return true, "restricted: not a member of this private group"
+		}
+	}
+	return false, ""
+}
+
+// QueryEvents wraps query, dropping events of private groups the requesting connection
+// may not read. Internal queries (no websocket connection in ctx) are left untouched.
+func (g *Groups) QueryEvents(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || ch == nil || khatru.GetConnection(ctx) == nil {
+			return ch, err
+		}
+
+		authed := khatru.GetAuthed(ctx)
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for evt := range ch {
+				if !g.CanRead(authed, evt) {
+					continue
+				}
+				select {
+				case out <- evt:
+				case <-ctx.Done():
+					// keep draining ch so the underlying query can finish
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// PreventBroadcast keeps events of private groups away from non-members.
+func (g *Groups) PreventBroadcast(ws *khatru.WebSocket, evt *nostr.Event) bool {
+	return !g.CanRead(ws.AuthedPublicKey, evt)
+}
@@ -0,0 +1,144 @@
+// Package hll keeps NIP-45 HyperLogLog registers for follower (kind 3 "#p") and reaction
+// (kind 7 "#e") counts, updated at write time so COUNT never scans the event indexes.
+package hll
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip45"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+// backfillKey marks that events stored before the registers existed were counted.
+const backfillKey = "hll-backfilled"
+
+// Store keeps the registers in Badger as "hll:<kind>:<referenced id or pubkey>".
+type Store struct {
+	db    *badger.DB
+	store eventstore.Store
+}
+
+// NewStore creates a Store on db, backfilling from store.
+func NewStore(db *badger.DB, store eventstore.Store) *Store {
+	return &Store{db: db, store: store}
+}
+
+// SaveEvent adds the author of evt to the registers of everything it references.
+// It is meant for the StoreEvent (reactions) and ReplaceEvent (follow lists) hooks.
+func (s *Store) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	for ref, offset := range nip45.HyperLogLogEventPubkeyOffsetsAndReferencesForEvent(evt) {
+		if err := s.add(key(evt.Kind, ref), offset, evt.PubKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountEventsHLL answers NIP-45 counts eligible for HyperLogLog from the stored registers.
+// khatru only calls it for filters with a single kind and a single "#p" or "#e" value.
+func (s *Store) CountEventsHLL(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+	var ref string
+	if values, ok := filter.Tags["p"]; ok && len(values) == 1 {
+		ref = values[0]
+	} else if values, ok := filter.Tags["e"]; ok && len(values) == 1 {
+		ref = values[0]
+	}
+	if ref == "" || len(filter.Kinds) != 1 {
+		return 0, nil, nil
+	}
+
+	registers, err := s.get(key(filter.Kinds[0], ref))
+	if err != nil {
+		return 0, nil, err
+	}
+	hll := hyperloglog.New(offset)
+	if registers != nil {
+		hll.MergeRegisters(registers)
+	}
+	return int64(hll.Count()), hll, nil
+}
+
+// Backfill counts the follow lists and reactions stored before the registers existed.
+// It scans them only once; later calls return immediately.
+func (s *Store) Backfill(ctx context.Context) (int, error) {
+	done := false
+	if err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(backfillKey))
+		done = err == nil
+		return nil
+	}); err != nil || done {
+		return 0, err
+	}
+
+	// a negentropy session lifts the store's query limit so every event is visited
+	ch, err := s.store.QueryEvents(eventstore.SetNegentropy(ctx), nostr.Filter{Kinds: []int{nostr.KindFollowList, nostr.KindReaction}})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for evt := range ch {
+		if err := s.SaveEvent(ctx, evt); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(backfillKey), nil)
+	})
+}
+
+// add merges pubkey into the registers at k, retrying when a concurrent write to the
+// same registers makes the transaction conflict.
+func (s *Store) add(k []byte, offset int, pubkey string) error {
+	for {
+		err := s.update(k, offset, pubkey)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (s *Store) update(k []byte, offset int, pubkey string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		hll := hyperloglog.New(offset)
+		item, err := txn.Get(k)
+		if err == nil {
+			if err := item.Value(func(val []byte) error {
+				hll.MergeRegisters(val)
+				return nil
+			}); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		hll.Add(pubkey)
+		return txn.Set(k, hll.GetRegisters())
+	})
+}
+
+func (s *Store) get(k []byte) ([]byte, error) {
+	var registers []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(k)
+		if err != nil {
+			return err
+		}
+		registers, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	return registers, err
+}
+
+func key(kind int, ref string) []byte {
+	return []byte("hll:" + strconv.Itoa(kind) + ":" + ref)
+}
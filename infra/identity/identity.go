@@ -0,0 +1,145 @@
+// Package identity normalizes the many ways a pubkey can be written (hex, npub,
+// nprofile and NIP-05 addresses) into the lowercase hex form used internally.
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+var (
+	ErrInvalidPubKey = errors.New("invalid pubkey")
+	ErrNotFound      = errors.New("nip05 identifier not found")
+)
+
+// Resolver resolves NIP-05 addresses to hex pubkeys.
+type Resolver interface {
+	Resolve(ctx context.Context, address string) (string, error)
+}
+
+// HTTPResolver resolves NIP-05 addresses by fetching the domain's /.well-known/nostr.json.
+type HTTPResolver struct{}
+
+// Resolve implements Resolver.
+func (HTTPResolver) Resolve(ctx context.Context, address string) (string, error) {
+	pointer, err := nip05.QueryIdentifier(ctx, address)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrNotFound, address, err)
+	}
+	return pointer.PublicKey, nil
+}
+
+// FileResolver resolves NIP-05 addresses from a local JSON file shaped like nostr.json,
+// whose "names" are full addresses ("alice@example.com", "_@example.com").
+// It stands in for HTTPResolver on offline relays and in tests.
+type FileResolver struct {
+	Path string
+}
+
+// Resolve implements Resolver. The file is read on every call so edits apply immediately.
+func (f FileResolver) Resolve(_ context.Context, address string) (string, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read nip05 file %s: %w", f.Path, err)
+	}
+	var wk nip05.WellKnownResponse
+	if err := json.Unmarshal(data, &wk); err != nil {
+		return "", fmt.Errorf("failed to parse nip05 file %s: %w", f.Path, err)
+	}
+	name, domain, err := nip05.ParseIdentifier(address)
+	if err != nil {
+		return "", err
+	}
+	pubkey, ok := wk.Names[name+"@"+domain]
+	if !ok || !nostr.IsValidPublicKey(pubkey) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, address)
+	}
+	return pubkey, nil
+}
+
+var (
+	resolverMu sync.RWMutex
+	resolver   Resolver = HTTPResolver{}
+)
+
+// SetResolver replaces the Resolver used by ParsePubKey.
+func SetResolver(r Resolver) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolver = r
+}
+
+// NewResolver returns the Resolver for the given kind ("http" or "file").
+func NewResolver(kind, path string) (Resolver, error) {
+	switch kind {
+	case "", "http":
+		return HTTPResolver{}, nil
+	case "file":
+		if path == "" {
+			return nil, errors.New("file resolver requires a path")
+		}
+		return FileResolver{Path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown nip05 resolver %q", kind)
+	}
+}
+
+// ParsePubKey accepts a pubkey as hex, npub, nprofile or NIP-05 address and returns it as hex.
+// Resolving an address may fetch the domain's nostr.json, so ParsePubKey is meant for trusted
+// input (configuration, CLI, management API); use DecodePubKey on what events carry.
+func ParsePubKey(ctx context.Context, raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.ContainsAny(raw, "@.") && nip05.IsValidIdentifier(raw) {
+		resolverMu.RLock()
+		r := resolver
+		resolverMu.RUnlock()
+		return r.Resolve(ctx, raw)
+	}
+	return DecodePubKey(raw)
+}
+
+// DecodePubKey accepts a pubkey as hex, npub or nprofile and returns it as hex, without
+// any network access.
+func DecodePubKey(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case strings.HasPrefix(raw, "npub1"), strings.HasPrefix(raw, "nprofile1"):
+		prefix, value, err := nip19.Decode(raw)
+		if err != nil {
+			return "", fmt.Errorf("%w %q: %v", ErrInvalidPubKey, raw, err)
+		}
+		switch prefix {
+		case "npub":
+			return value.(string), nil
+		case "nprofile":
+			return value.(nostr.ProfilePointer).PublicKey, nil
+		}
+	default:
+		if hex := strings.ToLower(raw); nostr.IsValidPublicKey(hex) {
+			return hex, nil
+		}
+	}
+	return "", fmt.Errorf("%w %q", ErrInvalidPubKey, raw)
+}
+
+// ParsePubKeys parses every entry of raw, failing on the first invalid one.
+func ParsePubKeys(ctx context.Context, raw []string) ([]string, error) {
+	pubkeys := make([]string, 0, len(raw))
+	for _, r := range raw {
+		pk, err := ParsePubKey(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		pubkeys = append(pubkeys, pk)
+	}
+	return pubkeys, nil
+}
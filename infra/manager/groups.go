@@ -0,0 +1,162 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var ErrNoGroup = errors.New("group not found")
+
+var groupIDRegex = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// Group is the metadata of a NIP-29 group hosted by this relay.
+type Group struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	About   string `json:"about,omitempty"`
+	Picture string `json:"picture,omitempty"`
+	// Private groups are only readable by their members.
+	Private bool `json:"private"`
+	// Closed groups only accept join requests carrying an invite code.
+	Closed    bool            `json:"closed"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+// ValidGroupID reports whether id is a valid NIP-29 group id.
+func ValidGroupID(id string) bool {
+	return groupIDRegex.MatchString(id)
+}
+
+// SaveGroup stores the metadata of group.
+func (m *Manager) SaveGroup(group Group) error {
+	return m.db.Update(func(txn *badger.Txn) error {
+		jdata, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte("group:"+group.ID), jdata)
+	})
+}
+
+// Group returns the metadata of the group id.
+func (m *Manager) Group(id string) (*Group, error) {
+	group := &Group{}
+	err := m.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("group:" + id))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, group)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNoGroup
+	}
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// DeleteGroup removes the group id with its members and invite codes.
+func (m *Manager) DeleteGroup(id string) error {
+	return m.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte("group:" + id)); err != nil {
+			return err
+		}
+		for _, prefix := range []string{"groupmember:" + id + ":", "groupinvite:" + id + ":"} {
+			var keys [][]byte
+			it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+			for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+			it.Close()
+			for _, key := range keys {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// SetGroupMember adds target to the group id, replacing its group roles.
+func (m *Manager) SetGroupMember(id, target string, roles []string) error {
+	if roles == nil {
+		roles = []string{}
+	}
+	return m.db.Update(func(txn *badger.Txn) error {
+		jdata, err := json.Marshal(roles)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte("groupmember:"+id+":"+target), jdata)
+	})
+}
+
+// RemoveGroupMember removes target from the group id.
+func (m *Manager) RemoveGroupMember(id, target string) error {
+	return m.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("groupmember:" + id + ":" + target))
+	})
+}
+
+// GroupRoles returns the roles target holds in the group id and whether it is a member.
+func (m *Manager) GroupRoles(id, target string) ([]string, bool) {
+	var roles []string
+	err := m.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("groupmember:" + id + ":" + target))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &roles)
+		})
+	})
+	return roles, err == nil
+}
+
+// GroupMembers returns every member of the group id mapped to its roles.
+func (m *Manager) GroupMembers(id string) (map[string][]string, error) {
+	members := make(map[string][]string)
+	err := m.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("groupmember:" + id + ":")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var roles []string
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &roles)
+			}); err != nil {
+				return err
+			}
+			members[string(item.Key()[len(prefix):])] = roles
+		}
+		return nil
+	})
+	return members, err
+}
+
+// AddGroupInvite registers an invite code for the group id.
+func (m *Manager) AddGroupInvite(id, code string) error {
+	return m.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("groupinvite:"+id+":"+code), nil)
+	})
+}
+
+// HasGroupInvite reports whether code is a valid invite code for the group id.
+func (m *Manager) HasGroupInvite(id, code string) bool {
+	err := m.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("groupinvite:" + id + ":" + code))
+		return err
+	})
+	return err == nil
+}
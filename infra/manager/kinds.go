@@ -0,0 +1,93 @@
+package manager
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// privateKindsKey holds the private kinds changed through the management API; until it is
+// first written, the private_kinds configuration applies.
+const privateKindsKey = "privatekinds"
+
+var ErrInvalidKind = errors.New("invalid kind")
+
+// PrivateKinds returns the kinds only served to their authenticated author or p-tagged
+// recipients. The list is read from the database once and kept in memory; callers must
+// not modify it.
+func (m *Manager) PrivateKinds() ([]int, error) {
+	m.kindsMu.Lock()
+	defer m.kindsMu.Unlock()
+	return m.privateKindsLocked()
+}
+
+// IsPrivateKind reports whether kind is private. The configured list is used while the
+// database cannot be read, so private events are never served by mistake.
+func (m *Manager) IsPrivateKind(kind int) bool {
+	kinds, err := m.PrivateKinds()
+	if err != nil {
+		kinds = config.Cfg.PrivateKinds
+	}
+	return slices.Contains(kinds, kind)
+}
+
+// SetPrivateKind makes kind private, or public again when private is false.
+func (m *Manager) SetPrivateKind(kind int, private bool) error {
+	if kind < 0 || kind > 65535 {
+		return ErrInvalidKind
+	}
+	m.kindsMu.Lock()
+	defer m.kindsMu.Unlock()
+	kinds, err := m.privateKindsLocked()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(kinds, kind) == private {
+		return nil
+	}
+	// a new slice, since callers may still hold the old one
+	if private {
+		kinds = append(slices.Clone(kinds), kind)
+		slices.Sort(kinds)
+	} else {
+		kinds = slices.DeleteFunc(slices.Clone(kinds), func(k int) bool { return k == kind })
+	}
+	if err := m.db.Update(func(txn *badger.Txn) error {
+		jdata, err := json.Marshal(kinds)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(privateKindsKey), jdata)
+	}); err != nil {
+		return err
+	}
+	m.privateKinds = kinds
+	return nil
+}
+
+func (m *Manager) privateKindsLocked() ([]int, error) {
+	if m.privateKinds != nil {
+		return m.privateKinds, nil
+	}
+	kinds := []int{}
+	err := m.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(privateKindsKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			kinds = append(kinds, config.Cfg.PrivateKinds...)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &kinds)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.privateKinds = kinds
+	return kinds, nil
+}
@@ -2,6 +2,7 @@ package manager
 
 import (
 	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/identity"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,38 +13,39 @@ import (
 	"github.com/nbd-wtf/go-nostr/nip86"
 	"github.com/nbd-wtf/go-nostr/sdk"
 	"slices"
+	"sync"
 )
 
-type ResourceType int8
 type Manager struct {
 	db *badger.DB
+
+	kindsMu      sync.Mutex
+	privateKinds []int
 }
 
 func NewManager(db *badger.DB) *Manager {
 	return &Manager{db: db}
 }
 
-const (
-	KindRelayAction              = 35000
-	ResourceInvite  ResourceType = iota
-	ResourceBlossom ResourceType = ResourceInvite + 1
-	ResourceBan     ResourceType = ResourceBlossom + 1
-)
+const KindRelayAction = 35000
 
 var (
 	ErrInvalidAction = errors.New("invalid action")
 	ErrMissingTags   = errors.New("missing required tags")
 	NoAccessError    = errors.New("no access to resource")
 	NoInvited        = errors.New("not invited")
-	NoResources      = errors.New("no resources")
+	NoRoles          = errors.New("no roles")
 )
 
 type BanEvent struct {
 	Reason string `json:"reason"`
 }
-type ResourceEvent struct {
-	Access   bool         `json:"access"`
-	Resource ResourceType `json:"resource"`
+
+// RoleEvent is the content of an "authorize" action: it grants Role to the target,
+// or revokes it when Access is false.
+type RoleEvent struct {
+	Access bool `json:"access"`
+	Role   Role `json:"role"`
 }
 
 func (m *Manager) SaveEvent(ctx context.Context, event *nostr.Event) error {
@@ -55,6 +57,10 @@ func (m *Manager) SaveEvent(ctx context.Context, event *nostr.Event) error {
 	if err != nil {
 		return err
 	}
+	// no NIP-05 lookups here: any member could make the relay fetch arbitrary domains
+	if target, err = identity.DecodePubKey(target); err != nil {
+		return err
+	}
 
 	switch action {
 	case "invite":
@@ -63,6 +69,8 @@ func (m *Manager) SaveEvent(ctx context.Context, event *nostr.Event) error {
 		return m.handleBan(target, event)
 	case "authorize":
 		return m.handleAuthorize(ctx, target, relay, event)
+	case "nip05":
+		return m.handleName(target, event)
 	default:
 		return ErrInvalidAction
 	}
@@ -87,7 +95,7 @@ func (m *Manager) handleInvite(target string, event *nostr.Event) error {
 		return fmt.Errorf("failed to parse metadata (%s) from event %s: %w", cont, event.ID, err)
 	}
 
-	if err := m.ValidateResource(event.PubKey, ResourceInvite); err == nil {
+	if err := m.ValidatePermission(event.PubKey, PermInvite); err == nil {
 		return m.saveInvited(target, profile)
 	}
 	return fmt.Errorf("failed to invite %s -> %s", event.PubKey, target)
@@ -97,20 +105,40 @@ func (m *Manager) handleBan(target string, event *nostr.Event) error {
 	if err := json.Unmarshal([]byte(event.Content), &banEvent); err != nil {
 		return err
 	}
-	if err := m.ValidateResource(event.PubKey, ResourceBan); err == nil {
-		m.saveBan(target, banEvent)
-		return m.deleteInvited(target)
+	if err := m.ValidatePermission(event.PubKey, PermBan); err == nil {
+		return m.Ban(target, banEvent.Reason)
 	}
 	return fmt.Errorf("failed to ban %s -> %s", event.PubKey, target)
 }
 func (m *Manager) handleAuthorize(ctx context.Context, target, relay string, event *nostr.Event) error {
-	var resourceEvent ResourceEvent
-	if err := json.Unmarshal([]byte(event.Content), &resourceEvent); err != nil {
+	var roleEvent RoleEvent
+	if err := json.Unmarshal([]byte(event.Content), &roleEvent); err != nil {
+		return err
+	}
+	role, err := ParseRole(string(roleEvent.Role))
+	if err != nil {
 		return err
 	}
-	currentResources, _ := m.queryResource(target)
-	updatedResources := append(currentResources, resourceEvent)
-	return m.saveResource(target, updatedResources)
+	if !m.CanGrant(event.PubKey, role) {
+		return fmt.Errorf("failed to authorize %s -> %s as %s", event.PubKey, target, role)
+	}
+	if !roleEvent.Access {
+		return m.Revoke(target, role)
+	}
+	return m.Grant(target, role)
+}
+func (m *Manager) handleName(target string, event *nostr.Event) error {
+	var nameEvent NameEvent
+	if err := json.Unmarshal([]byte(event.Content), &nameEvent); err != nil {
+		return err
+	}
+	if event.PubKey != target && m.ValidatePermission(event.PubKey, PermInvite) != nil {
+		return fmt.Errorf("failed to assign name %s -> %s", event.PubKey, target)
+	}
+	if nameEvent.Name == "" {
+		return m.ReleaseName(target)
+	}
+	return m.ClaimName(target, nameEvent.Name)
 }
 
 func (m *Manager) CheckAccess(target string) error {
@@ -123,24 +151,11 @@ func (m *Manager) CheckAccess(target string) error {
 	}
 	return nil
 }
-func (m *Manager) ValidateResource(target string, resource ResourceType) error {
-	resources, err := m.queryResource(target)
-	if err != nil {
-		return NoResources
-	}
-	for _, res := range resources {
-		if res.Resource == resource {
-			return nil
-		}
-	}
-	return NoAccessError
-}
-
 func extractTags(tags []nostr.Tag) (action, target, relay string, err error) {
 	for _, tag := range tags {
 		switch tag.Key() {
 		case "action":
-			if slices.Contains([]string{"invite", "ban", "authorize"}, tag.Value()) {
+			if slices.Contains([]string{"invite", "ban", "authorize", "nip05"}, tag.Value()) {
 				action = tag.Value()
 			}
 		case "target":
@@ -184,39 +199,6 @@ func (m *Manager) queryBan(target string) (*BanEvent, error) {
 
 	return data, nil
 }
-func (m *Manager) saveResource(target string, data []ResourceEvent) error {
-	key := []byte("resource:" + target)
-	return m.db.Update(func(txn *badger.Txn) error {
-		jdata, err := json.Marshal(data)
-		if err != nil {
-			return err
-		}
-		return txn.Set(key, jdata)
-	})
-}
-func (m *Manager) queryResource(target string) ([]ResourceEvent, error) {
-	key := []byte("resource:" + target)
-	var data []ResourceEvent
-	err := m.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
-		}
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &data)
-		})
-	})
-	if errors.Is(err, badger.ErrKeyNotFound) {
-		return []ResourceEvent{}, nil
-	}
-	return data, err
-}
-func (m *Manager) deleteResource(target string) error {
-	key := []byte("resource:" + target)
-	return m.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(key)
-	})
-}
 func (m *Manager) saveInvited(pubKey string, data sdk.ProfileMetadata) error {
 	key := []byte("invited:" + pubKey)
 	return m.db.Update(func(txn *badger.Txn) error {
@@ -261,10 +243,21 @@ func (m *Manager) RejectEvent() func(ctx context.Context, evt *nostr.Event) (boo
 			}
 		}
 
+		if m.IsBanned(evt.PubKey) {
+			return true, "blocked: you are banned from this relay"
+		}
+		if m.Denies(evt.PubKey, PermWrite) {
+			return true, "restricted: your roles do not allow writing"
+		}
+
 		if evt.Kind == KindRelayAction {
-			if _, _, _, err := extractTags(evt.Tags); err != nil {
+			_, target, _, err := extractTags(evt.Tags)
+			if err != nil {
 				return true, err.Error()
 			}
+			if _, err := identity.DecodePubKey(target); err != nil {
+				return true, "invalid: target must be a hex, npub or nprofile pubkey"
+			}
 			authenticatedUser := khatru.GetAuthed(ctx)
 			if authenticatedUser == "" {
 				return true, fmt.Sprintf("auth-required: %s", ErrMissingTags.Error())
@@ -278,6 +271,18 @@ func (m *Manager) RejectEvent() func(ctx context.Context, evt *nostr.Event) (boo
 	}
 }
 
+// OverwriteDeletionOutcome accepts a deletion from the target's author or from a pubkey
+// holding PermDeleteOthers.
+func (m *Manager) OverwriteDeletionOutcome(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string) {
+	if target.PubKey == deletion.PubKey {
+		return true, ""
+	}
+	if err := m.ValidatePermission(deletion.PubKey, PermDeleteOthers); err == nil {
+		return true, ""
+	}
+	return false, "you are not the author of this event"
+}
+
 func (m *Manager) ListBannedPubKeys() ([]nip86.PubKeyReason, error) {
 	var banned []nip86.PubKeyReason
 	err := m.db.View(func(txn *badger.Txn) error {
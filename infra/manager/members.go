@@ -0,0 +1,132 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/nbd-wtf/go-nostr/sdk"
+)
+
+// Member aggregates everything the Manager knows about a pubkey.
+type Member struct {
+	PubKey      string               `json:"pubkey"`
+	Invited     bool                 `json:"invited"`
+	Profile     *sdk.ProfileMetadata `json:"profile,omitempty"`
+	Banned      bool                 `json:"banned"`
+	BanReason   string               `json:"ban_reason,omitempty"`
+	Name        string               `json:"name,omitempty"`
+	Roles       []Role               `json:"roles"`
+	Permissions []Permission         `json:"permissions"`
+}
+
+// Invite marks target as invited, storing the given profile metadata.
+func (m *Manager) Invite(target string, profile sdk.ProfileMetadata) error {
+	return m.saveInvited(target, profile)
+}
+
+// Ban bans target with the given reason and removes its invite and NIP-05 name.
+func (m *Manager) Ban(target, reason string) error {
+	if err := m.saveBan(target, BanEvent{Reason: reason}); err != nil {
+		return err
+	}
+	if err := m.ReleaseName(target); err != nil {
+		return err
+	}
+	if err := m.deleteInvited(target); err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Unban lifts a ban on target. It does not restore a previous invite.
+func (m *Manager) Unban(target string) error {
+	return m.deleteBan(target)
+}
+
+// IsBanned reports whether target is banned.
+func (m *Manager) IsBanned(target string) bool {
+	_, err := m.queryBan(target)
+	return err == nil
+}
+
+// Show returns the aggregated Member record for target.
+func (m *Manager) Show(target string) (*Member, error) {
+	member := &Member{PubKey: target}
+
+	if profile, err := m.queryInvited(target); err == nil {
+		member.Invited = true
+		member.Profile = &profile
+	} else if !errors.Is(err, NoInvited) {
+		return nil, err
+	}
+
+	if ban, err := m.queryBan(target); err == nil {
+		member.Banned = true
+		member.BanReason = ban.Reason
+	}
+
+	if name, err := m.NameOf(target); err == nil {
+		member.Name = name
+	}
+
+	roles, err := m.Roles(target)
+	if err != nil {
+		return nil, err
+	}
+	member.Roles = roles
+	if member.Permissions, err = m.Permissions(target); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// ListInvited returns every invited pubkey along with the name from its stored profile.
+func (m *Manager) ListInvited() ([]nip86.PubKeyReason, error) {
+	var invited []nip86.PubKeyReason
+	err := m.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("invited:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var profile sdk.ProfileMetadata
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &profile)
+			}); err != nil {
+				return err
+			}
+			invited = append(invited, nip86.PubKeyReason{
+				PubKey: string(item.Key()[len(prefix):]),
+				Reason: profile.Name,
+			})
+		}
+		return nil
+	})
+	return invited, err
+}
+
+// Forget removes every record kept for target: invite, roles (including legacy
+// resources) and NIP-05 name. Bans are kept so a banned pubkey cannot vanish its way back in.
+func (m *Manager) Forget(target string) error {
+	if err := m.ReleaseName(target); err != nil {
+		return err
+	}
+	return m.db.Update(func(txn *badger.Txn) error {
+		for _, key := range []string{"invited:", "role:", "resource:"} {
+			if err := txn.Delete([]byte(key + target)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Manager) deleteBan(target string) error {
+	key := []byte("ban:" + target)
+	return m.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
@@ -0,0 +1,156 @@
+package manager
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var (
+	ErrInvalidName  = errors.New("invalid name")
+	ErrNameReserved = errors.New("name is reserved")
+	ErrNameTaken    = errors.New("name is already taken")
+	ErrNoName       = errors.New("no name claimed")
+)
+
+var nameRegex = regexp.MustCompile(`^[a-z0-9._-]{1,64}$`)
+
+// NameEvent is the content of a "nip05" action: it claims Name for the target,
+// or releases the target's current name when Name is empty.
+type NameEvent struct {
+	Name string `json:"name"`
+}
+
+// ClaimName assigns name to target, releasing any name target held before.
+// Names are unique and reserved names can only be claimed by the owner.
+func (m *Manager) ClaimName(target, name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !nameRegex.MatchString(name) {
+		return ErrInvalidName
+	}
+	if slices.Contains(config.Cfg.Nip05.Reserved, name) && !m.HasRole(target, RoleOwner) {
+		return ErrNameReserved
+	}
+	if err := m.CheckAccess(target); err != nil {
+		return err
+	}
+
+	return m.db.Update(func(txn *badger.Txn) error {
+		nameKey := []byte("nip05:" + name)
+		if item, err := txn.Get(nameKey); err == nil {
+			var owner []byte
+			if owner, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+			if string(owner) == target {
+				return nil
+			}
+			return ErrNameTaken
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		pubKeyKey := []byte("nip05pk:" + target)
+		if item, err := txn.Get(pubKeyKey); err == nil {
+			previous, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte("nip05:" + string(previous))); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		if err := txn.Set(nameKey, []byte(target)); err != nil {
+			return err
+		}
+		return txn.Set(pubKeyKey, []byte(name))
+	})
+}
+
+// ReleaseName frees the name held by target, if any.
+func (m *Manager) ReleaseName(target string) error {
+	return m.db.Update(func(txn *badger.Txn) error {
+		pubKeyKey := []byte("nip05pk:" + target)
+		item, err := txn.Get(pubKeyKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte("nip05:" + string(name))); err != nil {
+			return err
+		}
+		return txn.Delete(pubKeyKey)
+	})
+}
+
+// LookupName returns the pubkey holding name.
+func (m *Manager) LookupName(name string) (string, error) {
+	var pubkey string
+	err := m.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("nip05:" + strings.ToLower(name)))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			pubkey = string(val)
+			return nil
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", ErrNoName
+	}
+	return pubkey, err
+}
+
+// NameOf returns the name claimed by target.
+func (m *Manager) NameOf(target string) (string, error) {
+	var name string
+	err := m.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("nip05pk:" + target))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			name = string(val)
+			return nil
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return "", ErrNoName
+	}
+	return name, err
+}
+
+// ListNames returns every claimed name mapped to its pubkey.
+func (m *Manager) ListNames() (map[string]string, error) {
+	names := make(map[string]string)
+	err := m.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("nip05:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if err := item.Value(func(val []byte) error {
+				names[string(item.Key()[len(prefix):])] = string(val)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,80 @@
+package manager
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"strings"
+	"time"
+)
+
+// BlobQuota returns the blob storage quota of target: the most generous of the quotas
+// configured for its roles, its invite and the default. The owner is never limited.
+func (m *Manager) BlobQuota(target string) config.Quota {
+	quotas := config.Cfg.Blossom.Quotas
+	if m.HasRole(target, RoleOwner) {
+		return config.Quota{}
+	}
+
+	var quota config.Quota
+	found := false
+	for _, key := range append([]string{"default"}, m.blobClasses(target)...) {
+		q, ok := quotas[key]
+		if !ok {
+			continue
+		}
+		if !found {
+			quota, found = q, true
+			continue
+		}
+		quota.Bytes = moreGenerous(quota.Bytes, q.Bytes)
+		quota.Files = int(moreGenerous(int64(quota.Files), int64(q.Files)))
+	}
+	return quota
+}
+
+// BlobLifetime returns how long a blob of mimetype uploaded by target is kept, zero being
+// forever: the lifetime configured for its MIME type (or major type), else the default,
+// extended by the longest of those configured for its roles and invite. Uploads by the
+// owner are kept forever.
+func (m *Manager) BlobLifetime(target, mimetype string) time.Duration {
+	retention := config.Cfg.Blossom.Retention
+	if m.HasRole(target, RoleOwner) {
+		return 0
+	}
+
+	lifetime := retention.Default
+	major, _, _ := strings.Cut(mimetype, "/")
+	if d, ok := retention.Types[mimetype]; ok {
+		lifetime = d
+	} else if d, ok := retention.Types[major+"/*"]; ok {
+		lifetime = d
+	}
+	for _, key := range m.blobClasses(target) {
+		if d, ok := retention.Roles[key]; ok {
+			lifetime = time.Duration(moreGenerous(int64(lifetime), int64(d)))
+		}
+	}
+	return lifetime
+}
+
+// blobClasses returns the keys of the per-role blob settings that apply to target:
+// "invited" when it was invited, and each of its roles.
+func (m *Manager) blobClasses(target string) []string {
+	var keys []string
+	if m.CheckAccess(target) == nil {
+		keys = append(keys, "invited")
+	}
+	if roles, err := m.Roles(target); err == nil {
+		for _, role := range roles {
+			keys = append(keys, string(role))
+		}
+	}
+	return keys
+}
+
+// moreGenerous returns the larger limit, zero (unlimited) beating any other.
+func moreGenerous(a, b int64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
@@ -0,0 +1,254 @@
+package manager
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Role is a named set of permissions, defined in the "roles" section of the configuration.
+type Role string
+
+// Permission is a single capability granted through a Role.
+type Permission string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleUploader  Role = "uploader"
+	RoleReader    Role = "reader"
+	RoleBouncer   Role = "bouncer"
+)
+
+const (
+	PermWrite        Permission = "write"
+	PermRead         Permission = "read"
+	PermUpload       Permission = "upload"
+	PermInvite       Permission = "invite"
+	PermBan          Permission = "ban"
+	PermManageKinds  Permission = "manage-kinds"
+	PermDeleteOthers Permission = "delete-others"
+)
+
+// AllPermissions lists every known permission. The owner always holds all of them.
+var AllPermissions = []Permission{
+	PermWrite, PermRead, PermUpload, PermInvite, PermBan, PermManageKinds, PermDeleteOthers,
+}
+
+var ErrUnknownRole = errors.New("unknown role")
+
+// ParseRole returns the Role with the given name if it is defined in the configuration.
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if role == RoleOwner {
+		return role, nil
+	}
+	if _, ok := config.Cfg.Roles[name]; !ok {
+		return "", ErrUnknownRole
+	}
+	return role, nil
+}
+
+// Permissions returns the permissions granted by r.
+func (r Role) Permissions() []Permission {
+	if r == RoleOwner {
+		return AllPermissions
+	}
+	var perms []Permission
+	for _, p := range config.Cfg.Roles[string(r)] {
+		perms = append(perms, Permission(p))
+	}
+	return perms
+}
+
+// Roles returns the roles held by target. The configured relay owner always holds RoleOwner.
+func (m *Manager) Roles(target string) ([]Role, error) {
+	roles, err := m.queryRoles(target)
+	if err != nil {
+		return nil, err
+	}
+	if target == config.Cfg.Info.PubKey && !slices.Contains(roles, RoleOwner) {
+		roles = append([]Role{RoleOwner}, roles...)
+	}
+	return roles, nil
+}
+
+// Permissions returns the union of the permissions granted by every role held by target.
+func (m *Manager) Permissions(target string) ([]Permission, error) {
+	roles, err := m.Roles(target)
+	if err != nil {
+		return nil, err
+	}
+	var perms []Permission
+	for _, role := range roles {
+		for _, p := range role.Permissions() {
+			if !slices.Contains(perms, p) {
+				perms = append(perms, p)
+			}
+		}
+	}
+	return perms, nil
+}
+
+// HasRole reports whether target holds role.
+func (m *Manager) HasRole(target string, role Role) bool {
+	roles, err := m.Roles(target)
+	return err == nil && slices.Contains(roles, role)
+}
+
+// ValidatePermission returns nil if target holds a role granting perm.
+func (m *Manager) ValidatePermission(target string, perm Permission) error {
+	perms, err := m.Permissions(target)
+	if err != nil {
+		return err
+	}
+	if len(perms) == 0 {
+		return NoRoles
+	}
+	if slices.Contains(perms, perm) {
+		return nil
+	}
+	return NoAccessError
+}
+
+// Denies reports whether target holds roles of which none grants perm. Pubkeys without
+// roles are not denied anything here: what they may do is up to the relay's other policies,
+// so roles like reader only restrict their holders.
+func (m *Manager) Denies(target string, perm Permission) bool {
+	return errors.Is(m.ValidatePermission(target, perm), NoAccessError)
+}
+
+// CanGrant reports whether granter may grant or revoke role.
+// The owner may grant anything; admins may grant any role below admin.
+func (m *Manager) CanGrant(granter string, role Role) bool {
+	if m.HasRole(granter, RoleOwner) {
+		return true
+	}
+	if role == RoleOwner || role == RoleAdmin {
+		return false
+	}
+	return m.HasRole(granter, RoleAdmin)
+}
+
+// Grant gives role to target, keeping any roles already granted.
+func (m *Manager) Grant(target string, role Role) error {
+	roles, err := m.queryRoles(target)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(roles, role) {
+		return nil
+	}
+	return m.saveRoles(target, append(roles, role))
+}
+
+// Revoke removes role from target.
+func (m *Manager) Revoke(target string, role Role) error {
+	roles, err := m.queryRoles(target)
+	if err != nil {
+		return err
+	}
+	roles = slices.DeleteFunc(roles, func(r Role) bool { return r == role })
+	if len(roles) == 0 {
+		return m.deleteRoles(target)
+	}
+	return m.saveRoles(target, roles)
+}
+
+func (m *Manager) saveRoles(target string, roles []Role) error {
+	key := []byte("role:" + target)
+	return m.db.Update(func(txn *badger.Txn) error {
+		jdata, err := json.Marshal(roles)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, jdata)
+	})
+}
+func (m *Manager) queryRoles(target string) ([]Role, error) {
+	key := []byte("role:" + target)
+	var roles []Role
+	err := m.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &roles)
+		})
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return []Role{}, nil
+	}
+	return roles, err
+}
+func (m *Manager) deleteRoles(target string) error {
+	key := []byte("role:" + target)
+	return m.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+// legacyResources maps the integer resources stored by earlier versions to roles.
+// The old iota block started at 1, so invite was stored as 1, blossom as 2 and ban as 3.
+// Ban holders become bouncers rather than moderators, which could also upload and delete
+// others' events.
+var legacyResources = map[int8]Role{
+	1: RoleMember,
+	2: RoleUploader,
+	3: RoleBouncer,
+}
+
+// MigrateResources converts every legacy "resource:" record into "role:" records
+// and removes the old key. It returns how many pubkeys were migrated.
+func (m *Manager) MigrateResources() (int, error) {
+	legacy := make(map[string][]Role)
+	err := m.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("resource:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var resources []struct {
+				Access   bool `json:"access"`
+				Resource int8 `json:"resource"`
+			}
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &resources)
+			}); err != nil {
+				return err
+			}
+			var roles []Role
+			for _, res := range resources {
+				if role, ok := legacyResources[res.Resource]; ok && res.Access && !slices.Contains(roles, role) {
+					roles = append(roles, role)
+				}
+			}
+			legacy[string(item.Key()[len(prefix):])] = roles
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for target, roles := range legacy {
+		for _, role := range roles {
+			if err := m.Grant(target, role); err != nil {
+				return 0, err
+			}
+		}
+		if err := m.db.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte("resource:" + target))
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return len(legacy), nil
+}
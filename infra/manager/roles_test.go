@@ -0,0 +1,147 @@
+package manager
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var (
+	ownerKey = strings.Repeat("0", 63) + "1"
+	adminKey = strings.Repeat("0", 63) + "2"
+	otherKey = strings.Repeat("0", 63) + "3"
+)
+
+// newTestManager returns a Manager over an in-memory database with the default roles.
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	config.Cfg = &config.Config{
+		Info:  &config.Info{PubKey: ownerKey},
+		Roles: config.DefaultRoles,
+	}
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewManager(db)
+}
+
+func TestMigrateResources(t *testing.T) {
+	m := newTestManager(t)
+	// records as written by earlier versions
+	legacy := map[string]string{
+		strings.Repeat("a", 64): `[{"access":true,"resource":1}]`,
+		strings.Repeat("b", 64): `[{"access":true,"resource":2}]`,
+		strings.Repeat("c", 64): `[{"access":true,"resource":3}]`,
+		strings.Repeat("d", 64): `[{"access":true,"resource":1},{"access":true,"resource":2},{"access":true,"resource":1}]`,
+		strings.Repeat("e", 64): `[{"access":false,"resource":3}]`,
+		strings.Repeat("f", 64): `[{"access":true,"resource":9}]`,
+	}
+	want := map[string][]Role{
+		strings.Repeat("a", 64): {RoleMember},
+		strings.Repeat("b", 64): {RoleUploader},
+		strings.Repeat("c", 64): {RoleBouncer},
+		strings.Repeat("d", 64): {RoleMember, RoleUploader},
+		strings.Repeat("e", 64): {},
+		strings.Repeat("f", 64): {},
+	}
+	if err := m.db.Update(func(txn *badger.Txn) error {
+		for pk, val := range legacy {
+			if err := txn.Set([]byte("resource:"+pk), []byte(val)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.MigrateResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(legacy) {
+		t.Errorf("migrated %d pubkeys, want %d", n, len(legacy))
+	}
+	for pk, roles := range want {
+		got, err := m.Roles(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, roles) {
+			t.Errorf("%s…: roles = %v, want %v", pk[:4], got, roles)
+		}
+		if err := m.db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte("resource:" + pk))
+			return err
+		}); !errors.Is(err, badger.ErrKeyNotFound) {
+			t.Errorf("%s…: legacy record not removed: %v", pk[:4], err)
+		}
+	}
+
+	if n, err := m.MigrateResources(); err != nil || n != 0 {
+		t.Errorf("second migration = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestDenies(t *testing.T) {
+	m := newTestManager(t)
+	for name, perms := range config.DefaultRoles {
+		role := Role(name)
+		if err := m.Grant(otherKey, role); err != nil {
+			t.Fatal(err)
+		}
+		for _, perm := range AllPermissions {
+			want := !slices.Contains(perms, string(perm))
+			if got := m.Denies(otherKey, perm); got != want {
+				t.Errorf("%s: Denies(%s) = %v, want %v", role, perm, got, want)
+			}
+		}
+		if err := m.Revoke(otherKey, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, perm := range AllPermissions {
+		if m.Denies(ownerKey, perm) {
+			t.Errorf("owner: Denies(%s) = true", perm)
+		}
+		if m.Denies(otherKey, perm) {
+			t.Errorf("no roles: Denies(%s) = true", perm)
+		}
+	}
+}
+
+func TestCanGrant(t *testing.T) {
+	m := newTestManager(t)
+	if err := m.Grant(adminKey, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	granters := map[string]string{"owner": ownerKey, "admin": adminKey}
+	for name := range config.DefaultRoles {
+		if Role(name) == RoleAdmin {
+			continue
+		}
+		key := fmt.Sprintf("%064x", 16+len(granters))
+		if err := m.Grant(key, Role(name)); err != nil {
+			t.Fatal(err)
+		}
+		granters[name] = key
+	}
+	granters["none"] = otherKey
+
+	for granter, key := range granters {
+		for _, role := range []Role{RoleOwner, RoleAdmin, RoleModerator, RoleMember, RoleUploader, RoleReader, RoleBouncer} {
+			want := granter == "owner" || granter == "admin" && role != RoleOwner && role != RoleAdmin
+			if got := m.CanGrant(key, role); got != want {
+				t.Errorf("%s: CanGrant(%s) = %v, want %v", granter, role, got, want)
+			}
+		}
+	}
+}
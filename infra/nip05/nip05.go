@@ -0,0 +1,115 @@
+// Package nip05 serves the relay's /.well-known/nostr.json from the names members
+// have claimed through the Manager, so members get name@relay identities.
+package nip05
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+	"go.uber.org/zap"
+)
+
+// Server answers NIP-05 lookups.
+type Server struct {
+	m     *manager.Manager
+	store eventstore.Store
+}
+
+// NewServer creates a Server resolving names through m and relay lists through store.
+func NewServer(m *manager.Manager, store eventstore.Store) *Server {
+	return &Server{m: m, store: store}
+}
+
+// ServeHTTP answers GET /.well-known/nostr.json[?name=<name>]. Without a name every
+// claimed name is returned.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	resp := nip05.WellKnownResponse{
+		Names:  make(map[string]string),
+		Relays: make(map[string][]string),
+	}
+
+	if name := r.URL.Query().Get("name"); name != "" {
+		pubkey, err := s.m.LookupName(name)
+		if err != nil && !errors.Is(err, manager.ErrNoName) {
+			log.Logger.Error("Failed to look up nip05 name", zap.String("name", name), zap.Error(err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if pubkey != "" {
+			resp.Names[strings.ToLower(name)] = pubkey
+		}
+	} else {
+		names, err := s.m.ListNames()
+		if err != nil {
+			log.Logger.Error("Failed to list nip05 names", zap.Error(err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		resp.Names = names
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	for _, pubkey := range resp.Names {
+		resp.Relays[pubkey] = s.relaysOf(ctx, pubkey)
+	}
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Logger.Error("Failed to encode nip05 response", zap.Error(err))
+	}
+}
+
+// relaysOf returns the write relays from pubkey's latest kind 10002 relay list,
+// falling back to this relay alone.
+func (s *Server) relaysOf(ctx context.Context, pubkey string) []string {
+	self := RelayURL()
+	ch, err := s.store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{nostr.KindRelayListMetadata},
+		Authors: []string{pubkey},
+		Limit:   1,
+	})
+	if err != nil {
+		return []string{self}
+	}
+
+	relays := []string{self}
+	for evt := range ch {
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 || tag[0] != "r" {
+				continue
+			}
+			if len(tag) >= 3 && tag[2] == "read" {
+				continue
+			}
+			if url := nostr.NormalizeURL(tag[1]); url != self {
+				relays = append(relays, url)
+			}
+		}
+	}
+	return relays
+}
+
+// RelayURL returns the websocket URL of this relay derived from info.url.
+func RelayURL() string {
+	url := config.Cfg.Info.Url
+	switch {
+	case strings.HasPrefix(url, "https://"):
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	case strings.HasPrefix(url, "http://"):
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+	return nostr.NormalizeURL(url)
+}
@@ -0,0 +1,94 @@
+// Package nip98 validates the NIP-98 HTTP authorization events signing requests to the
+// NIP-86 management API and the NIP-96 file storage API.
+package nip98
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindHTTPAuth is the NIP-98 HTTP auth event kind.
+const KindHTTPAuth = 27235
+
+// Validate reads the NIP-98 authorization event of r, which must be signed within the
+// last minute for the method of r and for its URL: scheme, host and path, as seen by
+// the client through any reverse proxy. When payload is not nil and the event has a
+// "payload" tag, the tag must be the sha256 of payload.
+func Validate(r *http.Request, payload []byte) (*nostr.Event, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return nil, errors.New(`missing "Authorization" header`)
+	}
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New(`invalid "Authorization" header`)
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil || evt.Kind != KindHTTPAuth || !evt.CheckID() {
+		return nil, errors.New(`invalid "Authorization" event`)
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, errors.New(`invalid "Authorization" event signature`)
+	}
+	if now := nostr.Now(); evt.CreatedAt < now-60 || evt.CreatedAt > now+60 {
+		return nil, errors.New(`"Authorization" event is too old`)
+	}
+	if evt.Tags.GetFirst([]string{"method", r.Method}) == nil {
+		return nil, errors.New(`invalid "Authorization" event "method" tag`)
+	}
+	uTag := evt.Tags.GetFirst([]string{"u", ""})
+	if uTag == nil {
+		return nil, errors.New(`missing "Authorization" event "u" tag`)
+	}
+	signed, err := url.Parse((*uTag)[1])
+	if err != nil || !sameURL(signed, r) {
+		return nil, errors.New(`invalid "Authorization" event "u" tag`)
+	}
+	if tag := evt.Tags.GetFirst([]string{"payload", ""}); tag != nil && payload != nil {
+		sum := sha256.Sum256(payload)
+		if (*tag)[1] != hex.EncodeToString(sum[:]) {
+			return nil, errors.New(`invalid "Authorization" event "payload" tag`)
+		}
+	}
+	return &evt, nil
+}
+
+// sameURL reports whether signed is the URL r was addressed to, either directly or
+// through a reverse proxy, ignoring the query and a trailing slash.
+func sameURL(signed *url.URL, r *http.Request) bool {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return strings.EqualFold(signed.Scheme, scheme(r, host)) &&
+		strings.EqualFold(signed.Host, host) &&
+		strings.TrimSuffix(signed.Path, "/") == strings.TrimSuffix(r.URL.Path, "/")
+}
+
+// scheme returns the scheme r was addressed with. Without an X-Forwarded-Proto header
+// from the proxy it is guessed like khatru does: plain HTTP for localhost, hosts with a
+// port and bare IPs, HTTPS for anything else, which sits behind a TLS-terminating proxy.
+func scheme(r *http.Request, host string) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	if host == "localhost" || strings.Contains(host, ":") {
+		return "http"
+	}
+	if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); err == nil {
+		return "http"
+	}
+	return "https"
+}
@@ -0,0 +1,86 @@
+// Package pow requires NIP-13 proof of work from publishers, with the difficulty set per
+// kind and lowered or waived for invited members and role holders.
+package pow
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/manager"
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// Policy checks events against config.Cfg.Pow.
+type Policy struct {
+	m *manager.Manager
+}
+
+// NewPolicy creates a Policy looking up invites and roles through m.
+func NewPolicy(m *manager.Manager) *Policy {
+	return &Policy{m: m}
+}
+
+// MinDifficulty is the difficulty advertised in NIP-11, required from anyone
+// for kinds without their own setting.
+func MinDifficulty() int {
+	return config.Cfg.Pow.Default
+}
+
+// Enabled reports whether any event may need proof of work: the Invited and Roles caps
+// only lower a difficulty set by Default or Kinds.
+func Enabled() bool {
+	c := config.Cfg.Pow
+	if c.Default > 0 {
+		return true
+	}
+	for _, difficulty := range c.Kinds {
+		if difficulty > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Required returns the difficulty pubkey must commit to when publishing an event of kind.
+func (p *Policy) Required(pubkey string, kind int) int {
+	c := config.Cfg.Pow
+	required, ok := c.Kinds[kind]
+	if !ok {
+		required = c.Default
+	}
+	if required == 0 {
+		return 0
+	}
+
+	if c.Invited != nil && *c.Invited < required && p.m.CheckAccess(pubkey) == nil {
+		required = *c.Invited
+	}
+	roles, err := p.m.Roles(pubkey)
+	if err != nil {
+		return required
+	}
+	for _, role := range roles {
+		if role == manager.RoleOwner {
+			return 0
+		}
+		if capped, ok := c.Roles[string(role)]; ok && capped < required {
+			required = capped
+		}
+	}
+	return required
+}
+
+// RejectEvent is a policy refusing events whose committed difficulty (the target of
+// their "nonce" tag, when the id meets it) is below the required one.
+func (p *Policy) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	required := p.Required(evt.PubKey, evt.Kind)
+	if required <= 0 {
+		return false, ""
+	}
+	if work := nip13.CommittedDifficulty(evt); work < required {
+		return true, fmt.Sprintf("pow: committed difficulty %d is less than %d", work, required)
+	}
+	return false, ""
+}
@@ -0,0 +1,166 @@
+// Package relayinfo builds the NIP-11 relay information document from the configuration
+// and the policies actually wired into the relay.
+package relayinfo
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/log"
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"go.uber.org/zap"
+)
+
+// Software is the repository advertised as the relay software.
+const Software = "https://github.com/gabrielmoura/SimpleNosrtRelay"
+
+// Document is the NIP-11 document extended with the fields go-nostr does not model yet.
+type Document struct {
+	nip11.RelayInformationDocument
+	// Self is the relay's own pubkey, which signs NIP-29 group state.
+	Self      string             `json:"self,omitempty"`
+	Banner    string             `json:"banner,omitempty"`
+	Retention []config.Retention `json:"retention,omitempty"`
+	// BlobRetention tells how long Blossom and NIP-96 uploads are kept.
+	BlobRetention *BlobRetention `json:"blob_retention,omitempty"`
+	// Pow details the NIP-13 difficulty per kind, which limitation.min_pow_difficulty
+	// can only give for kinds without their own setting.
+	Pow *Pow `json:"pow,omitempty"`
+}
+
+// Pow is the proof of work required to publish. Kinds overrides Default; Invited and Roles
+// cap the difficulty asked from invited members and role holders.
+type Pow struct {
+	Default int            `json:"default"`
+	Kinds   map[int]int    `json:"kinds,omitempty"`
+	Invited *int           `json:"invited,omitempty"`
+	Roles   map[string]int `json:"roles,omitempty"`
+}
+
+// proofOfWork returns the configured proof of work, or nil when only the default, already in
+// limitation.min_pow_difficulty, applies.
+func proofOfWork() *Pow {
+	c := config.Cfg.Pow
+	if len(c.Kinds) == 0 {
+		return nil
+	}
+	return &Pow{Default: c.Default, Kinds: c.Kinds, Invited: c.Invited, Roles: c.Roles}
+}
+
+// BlobRetention is how long blobs are kept, in seconds; zero is forever. Types and Roles
+// are keyed like the configuration.
+type BlobRetention struct {
+	Default int64            `json:"default"`
+	Types   map[string]int64 `json:"types,omitempty"`
+	Roles   map[string]int64 `json:"roles,omitempty"`
+	MaxIdle int64            `json:"max_idle,omitempty"`
+}
+
+// blobRetention returns the configured blob retention, or nil when blobs are kept forever.
+func blobRetention() *BlobRetention {
+	c := config.Cfg.Blossom
+	if !c.Enabled || (c.Retention.Default == 0 && len(c.Retention.Types) == 0 && c.Retention.MaxIdle == 0) {
+		return nil
+	}
+	seconds := func(durations map[string]time.Duration) map[string]int64 {
+		out := make(map[string]int64, len(durations))
+		for key, d := range durations {
+			out[key] = int64(d.Seconds())
+		}
+		return out
+	}
+	return &BlobRetention{
+		Default: int64(c.Retention.Default.Seconds()),
+		Types:   seconds(c.Retention.Types),
+		Roles:   seconds(c.Retention.Roles),
+		MaxIdle: int64(c.Retention.MaxIdle.Seconds()),
+	}
+}
+
+// Populate fills info from config.Cfg.Info. Supported NIPs start from the ones every
+// configuration provides (basic protocol, NIP-11, NIP-42 auth and NIP-86 management);
+// features add their own as they are enabled.
+func Populate(info *nip11.RelayInformationDocument, version string) {
+	c := config.Cfg.Info
+	info.Name = c.Name
+	info.PubKey = c.PubKey
+	info.Description = c.Description
+	info.Contact = c.Contact
+	info.Icon = c.Icon
+	info.URL = c.Url
+	info.Software = Software
+	info.Version = version
+	info.RelayCountries = c.RelayCountries
+	info.LanguageTags = c.LanguageTags
+	info.Tags = c.Tags
+	info.PostingPolicy = c.PostingPolicy
+	info.PaymentsURL = c.PaymentsURL
+	info.Fees = c.Fees
+	info.SupportedNIPs = []any{1, 11, 42, 86}
+}
+
+// PaymentRequired reports whether the configured fees charge for admission or subscriptions.
+func PaymentRequired() bool {
+	fees := config.Cfg.Info.Fees
+	return fees != nil && (len(fees.Admission) > 0 || len(fees.Subscription) > 0)
+}
+
+// Limitation derives the NIP-11 limitation object from the relay and the active policies.
+// maxLimit is the event store's cap on query results, minPow the advertised difficulty and
+// pow whether any event may need proof of work.
+func Limitation(relay *khatru.Relay, maxLimit, minPow int, pow bool) *nip11.RelayLimitationDocument {
+	payment := PaymentRequired()
+	return &nip11.RelayLimitationDocument{
+		MaxMessageLength: int(relay.MaxMessageSize),
+		MaxLimit:         maxLimit,
+		MinPowDifficulty: minPow,
+		AuthRequired:     config.Cfg.AuthRequired,
+		PaymentRequired:  payment,
+		RestrictedWrites: config.Cfg.AuthRequired || payment || pow,
+	}
+}
+
+// Handler serves the NIP-11 document, banner, event and blob retention and proof of work
+// included, in front of next.
+// Everything else is passed on to next.
+func Handler(relay *khatru.Relay, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/nostr+json" || r.Header.Get("Upgrade") == "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info := *relay.Info
+		info.SupportedNIPs = slices.Clone(info.SupportedNIPs)
+		for _, ovw := range relay.OverwriteRelayInformation {
+			info = ovw(r.Context(), r, info)
+		}
+		slices.SortFunc(info.SupportedNIPs, func(a, b any) int {
+			x, _ := a.(int)
+			y, _ := b.(int)
+			return cmp.Compare(x, y)
+		})
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/nostr+json")
+		doc := Document{
+			RelayInformationDocument: info,
+			Banner:                   config.Cfg.Info.Banner,
+			Retention:                config.Cfg.Info.Retention,
+			BlobRetention:            blobRetention(),
+			Pow:                      proofOfWork(),
+		}
+		if config.Cfg.Groups.Enabled {
+			doc.Self, _ = nostr.GetPublicKey(config.Cfg.Groups.SecretKey)
+		}
+		if err := json.NewEncoder(w).Encode(doc); err != nil {
+			log.Logger.Error("Failed to encode relay information", zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,454 @@
+// Package report turns NIP-56 reports (kind 1984) into a moderation queue: reports are
+// aggregated per reported event or pubkey, content reported by enough trusted reporters
+// can be hidden automatically, and moderators resolve each entry with a single action.
+package report
+
+import (
+	"SimpleNosrtRelay/infra/config"
+	"SimpleNosrtRelay/infra/manager"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// backfillKey marks that reports stored before the queue existed were indexed.
+const backfillKey = "report-backfilled"
+
+// Action is how a moderator resolves the reports about a target.
+type Action string
+
+const (
+	// ActionDismiss drops the reports and shows the target again.
+	ActionDismiss Action = "dismiss"
+	// ActionHide keeps the target hidden from everyone but moderators.
+	ActionHide Action = "hide"
+	// ActionDelete deletes the reported event, or every event of the reported pubkey.
+	ActionDelete Action = "delete"
+	// ActionBan bans the reported pubkey, or the reported event's author, and deletes the event.
+	ActionBan Action = "ban"
+)
+
+var (
+	ErrUnknownAction = errors.New("unknown action, use dismiss, hide, delete or ban")
+	ErrNoReports     = errors.New("no reports about this target")
+	ErrEventNotFound = errors.New("reported event not found, its author cannot be banned")
+)
+
+// Report is a single reporter's latest report about a target.
+type Report struct {
+	ID       string `json:"id"`
+	Reporter string `json:"reporter"`
+	// Event is set when the target is an event rather than a pubkey.
+	Event bool `json:"event"`
+	// PubKey is the reported pubkey, or the reported event's author.
+	PubKey    string          `json:"pubkey"`
+	Type      string          `json:"type"`
+	Content   string          `json:"content,omitempty"`
+	Trusted   bool            `json:"trusted"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+// Summary aggregates the reports about a target for the moderation queue.
+type Summary struct {
+	Target  string         `json:"target"`
+	Event   bool           `json:"event"`
+	PubKey  string         `json:"pubkey"`
+	Reports int            `json:"reports"`
+	Trusted int            `json:"trusted"`
+	Types   map[string]int `json:"types"`
+	// Comments are the free-form contents of the reports.
+	Comments []string        `json:"comments,omitempty"`
+	Hidden   bool            `json:"hidden"`
+	Last     nostr.Timestamp `json:"last_report"`
+}
+
+// Queue stores reports as "report:<target>:<reporter>" and hidden targets as "reporthidden:<target>".
+type Queue struct {
+	db    *badger.DB
+	store eventstore.Store
+	m     *manager.Manager
+	// DeleteEvent is called in order for every event removed by ActionDelete and ActionBan.
+	DeleteEvent []func(ctx context.Context, evt *nostr.Event) error
+}
+
+// NewQueue creates a Queue on db, looking up reported events in store and reporters through m.
+func NewQueue(db *badger.DB, store eventstore.Store, m *manager.Manager) *Queue {
+	return &Queue{db: db, store: store, m: m}
+}
+
+// Trusted reports whether reports from pubkey count towards hiding content: moderators
+// (holders of the ban permission) and invited members are trusted.
+func (q *Queue) Trusted(pubkey string) bool {
+	return q.m.ValidatePermission(pubkey, manager.PermBan) == nil || q.m.CheckAccess(pubkey) == nil
+}
+
+// RejectEvent is a policy refusing reports that do not name who is being reported, or
+// whose targets are not hex ids, since they become queue keys and ban targets.
+func (q *Queue) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if evt.Kind != nostr.KindReporting {
+		return false, ""
+	}
+	if msg := invalidTargets(evt); msg != "" {
+		return true, msg
+	}
+	return false, ""
+}
+
+// invalidTargets explains why the "p" and "e" tags of a report are unusable, or returns ""
+// when they are valid.
+func invalidTargets(evt *nostr.Event) string {
+	p := evt.Tags.GetFirst([]string{"p", ""})
+	if p == nil {
+		return `invalid: reports must tag the reported pubkey with a "p" tag`
+	}
+	if !nostr.IsValid32ByteHex((*p)[1]) {
+		return `invalid: the "p" tag must be a lowercase hex pubkey`
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "e" && !nostr.IsValid32ByteHex(tag[1]) {
+			return `invalid: "e" tags must be lowercase hex event ids`
+		}
+	}
+	return ""
+}
+
+// SaveEvent indexes a report, replacing any earlier report by the same reporter about the
+// same target, and hides the target once config.Cfg.Reports.HideThreshold is reached.
+// Reports RejectEvent would refuse, stored before it existed, are skipped.
+func (q *Queue) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if evt.Kind != nostr.KindReporting || invalidTargets(evt) != "" {
+		return nil
+	}
+	p := evt.Tags.GetFirst([]string{"p", ""})
+
+	report := Report{
+		ID:        evt.ID,
+		Reporter:  evt.PubKey,
+		PubKey:    (*p)[1],
+		Type:      reportType(*p),
+		Content:   evt.Content,
+		Trusted:   q.Trusted(evt.PubKey),
+		CreatedAt: evt.CreatedAt,
+	}
+	targets := map[string]Report{report.PubKey: report}
+	var events []string
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			events = append(events, tag[1])
+		}
+	}
+	if len(events) > 0 {
+		// an event report is about the events, not their author; the author comes from the
+		// stored event, since the reporter's "p" tag could name anyone
+		report.Event = true
+		if e := evt.Tags.GetFirst([]string{"e", ""}); e != nil && len(*e) >= 3 {
+			report.Type = reportType(*e)
+		}
+		targets = make(map[string]Report, len(events))
+		for _, id := range events {
+			report.PubKey = ""
+			if target := q.event(ctx, id); target != nil {
+				report.PubKey = target.PubKey
+			}
+			targets[id] = report
+		}
+	}
+
+	threshold := config.Cfg.Reports.HideThreshold
+	return q.db.Update(func(txn *badger.Txn) error {
+		for target, report := range targets {
+			jdata, err := json.Marshal(report)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte("report:"+target+":"+report.Reporter), jdata); err != nil {
+				return err
+			}
+			if threshold <= 0 || !report.Trusted {
+				continue
+			}
+			reports, err := reportsOf(txn, target)
+			if err != nil {
+				return err
+			}
+			trusted := 0
+			for _, r := range reports {
+				if r.Trusted {
+					trusted++
+				}
+			}
+			if trusted >= threshold {
+				if err := txn.Set([]byte("reporthidden:"+target), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Backfill indexes the reports stored before the queue existed.
+// It scans them only once; later calls return immediately.
+func (q *Queue) Backfill(ctx context.Context) (int, error) {
+	done := false
+	if err := q.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(backfillKey))
+		done = err == nil
+		return nil
+	}); err != nil || done {
+		return 0, err
+	}
+
+	// a negentropy session lifts the store's query limit so every event is visited
+	ch, err := q.store.QueryEvents(eventstore.SetNegentropy(ctx), nostr.Filter{Kinds: []int{nostr.KindReporting}})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for evt := range ch {
+		if err := q.SaveEvent(ctx, evt); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, q.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(backfillKey), nil)
+	})
+}
+
+// reportType returns the NIP-56 report type (nudity, spam, illegal...) carried by tag.
+func reportType(tag nostr.Tag) string {
+	if len(tag) >= 3 && tag[2] != "" {
+		return tag[2]
+	}
+	return "other"
+}
+
+// List returns the moderation queue, most reported targets first.
+func (q *Queue) List() ([]Summary, error) {
+	summaries := []Summary{}
+	err := q.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("report:")
+		index := make(map[string]int)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			target, _, ok := strings.Cut(string(item.Key()[len(prefix):]), ":")
+			if !ok {
+				continue
+			}
+			var report Report
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &report)
+			}); err != nil {
+				return err
+			}
+
+			i, ok := index[target]
+			if !ok {
+				i = len(summaries)
+				index[target] = i
+				summaries = append(summaries, Summary{
+					Target: target,
+					Event:  report.Event,
+					PubKey: report.PubKey,
+					Types:  make(map[string]int),
+					Hidden: isHidden(txn, target),
+				})
+			}
+			s := &summaries[i]
+			s.Reports++
+			if report.Trusted {
+				s.Trusted++
+			}
+			s.Types[report.Type]++
+			if report.Content != "" {
+				s.Comments = append(s.Comments, report.Content)
+			}
+			s.Last = max(s.Last, report.CreatedAt)
+		}
+		return nil
+	})
+
+	slices.SortStableFunc(summaries, func(a, b Summary) int {
+		if a.Reports != b.Reports {
+			return b.Reports - a.Reports
+		}
+		return int(b.Last - a.Last)
+	})
+	return summaries, err
+}
+
+// Resolve applies action to target (a reported event id or pubkey) and removes it from the queue.
+func (q *Queue) Resolve(ctx context.Context, target string, action Action) error {
+	var reports []Report
+	if err := q.db.View(func(txn *badger.Txn) error {
+		var err error
+		reports, err = reportsOf(txn, target)
+		return err
+	}); err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		return ErrNoReports
+	}
+	event, pubkey := reports[0].Event, target
+
+	filter := nostr.Filter{Authors: []string{target}}
+	if event {
+		filter = nostr.Filter{IDs: []string{target}}
+		// ban the stored event's author, never a pubkey named by a reporter
+		pubkey = ""
+		if evt := q.event(ctx, target); evt != nil {
+			pubkey = evt.PubKey
+		}
+		if pubkey == "" && action == ActionBan {
+			return ErrEventNotFound
+		}
+	}
+	switch action {
+	case ActionDismiss, ActionHide:
+	case ActionDelete:
+		if err := q.deleteEvents(ctx, filter); err != nil {
+			return err
+		}
+	case ActionBan:
+		if err := q.m.Ban(pubkey, "reported: "+reports[0].Type); err != nil {
+			return err
+		}
+		if event {
+			if err := q.deleteEvents(ctx, filter); err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrUnknownAction
+	}
+
+	return q.db.Update(func(txn *badger.Txn) error {
+		for _, report := range reports {
+			if err := txn.Delete([]byte("report:" + target + ":" + report.Reporter)); err != nil {
+				return err
+			}
+		}
+		if action == ActionHide {
+			return txn.Set([]byte("reporthidden:"+target), nil)
+		}
+		return txn.Delete([]byte("reporthidden:" + target))
+	})
+}
+
+// event returns the stored event with id, or nil when the relay does not have it.
+func (q *Queue) event(ctx context.Context, id string) *nostr.Event {
+	ch, err := q.store.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return nil
+	}
+	var found *nostr.Event
+	for evt := range ch {
+		if found == nil {
+			found = evt
+		}
+	}
+	return found
+}
+
+func (q *Queue) deleteEvents(ctx context.Context, filter nostr.Filter) error {
+	// a negentropy session lifts the store's query limit so every event is visited
+	ch, err := q.store.QueryEvents(eventstore.SetNegentropy(ctx), filter)
+	if err != nil {
+		return err
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	for _, evt := range events {
+		for _, del := range q.DeleteEvent {
+			if err := del(ctx, evt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Hidden reports whether evt was hidden, either itself or through its author.
+func (q *Queue) Hidden(evt *nostr.Event) bool {
+	hidden := false
+	q.db.View(func(txn *badger.Txn) error {
+		hidden = isHidden(txn, evt.ID) || isHidden(txn, evt.PubKey)
+		return nil
+	})
+	return hidden
+}
+
+// visibleTo reports whether the connection authenticated as pubkey sees hidden content.
+func (q *Queue) visibleTo(pubkey string) bool {
+	return pubkey != "" && q.m.ValidatePermission(pubkey, manager.PermBan) == nil
+}
+
+// QueryEvents wraps query, dropping hidden content unless the requesting connection is a
+// moderator. Internal queries (no websocket connection in ctx) are left untouched.
+func (q *Queue) QueryEvents(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || ch == nil || khatru.GetConnection(ctx) == nil || q.visibleTo(khatru.GetAuthed(ctx)) {
+			return ch, err
+		}
+
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for evt := range ch {
+				if q.Hidden(evt) {
+					continue
+				}
+				select {
+				case out <- evt:
+				case <-ctx.Done():
+					// keep draining ch so the underlying query can finish
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// PreventBroadcast keeps new events of hidden pubkeys away from everyone but moderators.
+func (q *Queue) PreventBroadcast(ws *khatru.WebSocket, evt *nostr.Event) bool {
+	return !q.visibleTo(ws.AuthedPublicKey) && q.Hidden(evt)
+}
+
+func reportsOf(txn *badger.Txn, target string) ([]Report, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var reports []Report
+	prefix := []byte("report:" + target + ":")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		var report Report
+		if err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &report)
+		}); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func isHidden(txn *badger.Txn, target string) bool {
+	_, err := txn.Get([]byte("reporthidden:" + target))
+	return err == nil
+}
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"SimpleNosrtRelay/infra/access"
 	"SimpleNosrtRelay/infra/config"
 	"SimpleNosrtRelay/infra/log"
 	"context"
@@ -25,6 +26,11 @@ func (r *RelaPool) ForwardEvent() func(ctx context.Context, event *nostr.Event)
 		if config.Cfg.Stream.Enabled {
 			return nil
 		}
+		// protected events (NIP-70) must never be republished to other relays, and group
+		// events (NIP-29) only mean something on the relay hosting the group
+		if access.IsProtected(event) || event.Tags.GetFirst([]string{"h", ""}) != nil {
+			return nil
+		}
 		if len(r.StreamPoll) > 0 {
 			r.msg <- *event
 		}
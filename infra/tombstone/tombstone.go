@@ -0,0 +1,244 @@
+// Package tombstone remembers NIP-09 deletions so deleted events cannot come back
+// through re-imports, mirrors or third parties republishing them.
+package tombstone
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+const prefix = "tombstone:"
+
+// Tombstone records that events matching a reference were deleted.
+type Tombstone struct {
+	DeletionID string `json:"deletion_id"`
+	// CreatedAt is the deletion's created_at; versions of an addressable event
+	// created at or before it stay deleted.
+	CreatedAt  nostr.Timestamp `json:"created_at"`
+	RecordedAt nostr.Timestamp `json:"recorded_at"`
+}
+
+// Store keeps tombstones in Badger.
+//
+// Event references are keyed by id and author ("tombstone:e:<id>:<pubkey>") so a deletion
+// only ever blocks events of the pubkey it was checked against; addressable references
+// carry their author already ("tombstone:a:<kind>:<pubkey>:<d>").
+type Store struct {
+	db *badger.DB
+}
+
+// NewStore creates a Store on db.
+func NewStore(db *badger.DB) *Store {
+	return &Store{db: db}
+}
+
+// OverwriteDeletionOutcome wraps the relay's deletion decision, recording a tombstone for
+// target whenever decide accepts the deletion. khatru only consults this hook for targets
+// it has stored; deletions of events the relay has not seen are recorded by
+// OverwriteResponseEvent.
+func (s *Store) OverwriteDeletionOutcome(decide func(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string)) func(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string) {
+	return func(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string) {
+		accept, msg := decide(ctx, target, deletion)
+		if accept {
+			if err := s.RecordTarget(target, deletion); err != nil {
+				log.Logger.Error("Failed to record tombstone", zap.String("ID", target.ID), zap.Error(err))
+			}
+		}
+		return accept, msg
+	}
+}
+
+// RecordTarget records a tombstone for target, whose deletion was already authorized.
+func (s *Store) RecordTarget(target, deletion *nostr.Event) error {
+	ts := s.newTombstone(deletion)
+	if err := s.save(eventKey(target.ID, target.PubKey), ts); err != nil {
+		return err
+	}
+	if nostr.IsAddressableKind(target.Kind) || nostr.IsReplaceableKind(target.Kind) {
+		return s.saveAddress(addressKey(target.Kind, target.PubKey, target.Tags.GetD()), ts)
+	}
+	return nil
+}
+
+// OverwriteResponseEvent records the tombstones of every accepted kind 5 event, including
+// references to events the relay has not stored (yet), so they are refused when they show
+// up later. khatru neither stores deletions nor passes them to StoreEvent; this hook is the
+// only one it calls for each accepted deletion. It also sees query results, which is
+// harmless since recording a deletion twice changes nothing.
+func (s *Store) OverwriteResponseEvent(ctx context.Context, evt *nostr.Event) {
+	if err := s.RecordDeletion(evt); err != nil {
+		log.Logger.Error("Failed to record tombstone", zap.String("ID", evt.ID), zap.Error(err))
+	}
+}
+
+// RecordDeletion records a tombstone for every "e" and "a" reference of a kind 5 event.
+// The author check is enforced by keying references to the deletion's author: an "e"
+// tombstone only blocks events by that author and "a" references to other authors are ignored.
+func (s *Store) RecordDeletion(deletion *nostr.Event) error {
+	if deletion.Kind != nostr.KindDeletion {
+		return nil
+	}
+	ts := s.newTombstone(deletion)
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			key := eventKey(tag[1], deletion.PubKey)
+			if _, err := s.get(key); err == nil {
+				// keep the first recording, so repeats do not postpone its purge
+				continue
+			}
+			if err := s.save(key, ts); err != nil {
+				return err
+			}
+		case "a":
+			spl := strings.SplitN(tag[1], ":", 3)
+			if len(spl) != 3 || spl[1] != deletion.PubKey {
+				continue
+			}
+			kind, err := strconv.Atoi(spl[0])
+			if err != nil {
+				continue
+			}
+			if err := s.saveAddress(addressKey(kind, spl[1], spl[2]), ts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IsDeleted reports whether evt matches a tombstone.
+func (s *Store) IsDeleted(evt *nostr.Event) bool {
+	if _, err := s.get(eventKey(evt.ID, evt.PubKey)); err == nil {
+		return true
+	}
+	if nostr.IsAddressableKind(evt.Kind) || nostr.IsReplaceableKind(evt.Kind) {
+		ts, err := s.get(addressKey(evt.Kind, evt.PubKey, evt.Tags.GetD()))
+		if err == nil && evt.CreatedAt <= ts.CreatedAt {
+			return true
+		}
+	}
+	return false
+}
+
+// RejectEvent is a policy rejecting events that were deleted before.
+func (s *Store) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if s.IsDeleted(evt) {
+		return true, "blocked: this event was deleted"
+	}
+	return false, ""
+}
+
+// Purge removes tombstones recorded more than maxAge ago and returns how many were removed.
+func (s *Store) Purge(maxAge time.Duration) (int, error) {
+	cutoff := nostr.Timestamp(time.Now().Add(-maxAge).Unix())
+	var expired [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			item := it.Item()
+			var ts Tombstone
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &ts)
+			}); err != nil {
+				return err
+			}
+			if ts.RecordedAt < cutoff {
+				expired = append(expired, item.KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err := s.db.Update(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// StartPurge purges tombstones older than maxAge every interval until ctx is done.
+func (s *Store) StartPurge(ctx context.Context, maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.Purge(maxAge)
+			if err != nil {
+				log.Logger.Error("Failed to purge tombstones", zap.Error(err))
+				continue
+			}
+			log.Logger.Debug("Purged tombstones", zap.Int("count", n))
+		}
+	}
+}
+
+func (s *Store) newTombstone(deletion *nostr.Event) Tombstone {
+	return Tombstone{DeletionID: deletion.ID, CreatedAt: deletion.CreatedAt, RecordedAt: nostr.Now()}
+}
+
+func (s *Store) save(key []byte, ts Tombstone) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		jdata, err := json.Marshal(ts)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, jdata)
+	})
+}
+
+// saveAddress keeps the newest deletion for an address so older deletions never
+// unblock versions a later one covered.
+func (s *Store) saveAddress(key []byte, ts Tombstone) error {
+	if current, err := s.get(key); err == nil && current.CreatedAt >= ts.CreatedAt {
+		return nil
+	}
+	return s.save(key, ts)
+}
+
+func (s *Store) get(key []byte) (*Tombstone, error) {
+	ts := &Tombstone{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, ts)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func eventKey(id, pubkey string) []byte {
+	return []byte(prefix + "e:" + id + ":" + pubkey)
+}
+
+func addressKey(kind int, pubkey, d string) []byte {
+	return []byte(prefix + "a:" + strconv.Itoa(kind) + ":" + pubkey + ":" + d)
+}
@@ -0,0 +1,107 @@
+package tombstone
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+const (
+	authorKey = "000000000000000000000000000000000000000000000000000000000000000a"
+	otherKey  = "000000000000000000000000000000000000000000000000000000000000000b"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	log.Logger = zap.NewNop()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewStore(db)
+}
+
+func signed(t *testing.T, sk string, evt nostr.Event) *nostr.Event {
+	t.Helper()
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return &evt
+}
+
+func TestRejectEvent(t *testing.T) {
+	s := newTestStore(t)
+	author, _ := nostr.GetPublicKey(authorKey)
+	now := nostr.Now()
+
+	note := signed(t, authorKey, nostr.Event{Kind: nostr.KindTextNote, CreatedAt: now - 100, Content: "deleted"})
+	article := func(sk string, createdAt nostr.Timestamp) *nostr.Event {
+		return signed(t, sk, nostr.Event{Kind: nostr.KindArticle, CreatedAt: createdAt, Tags: nostr.Tags{{"d", "post"}}})
+	}
+	profile := func(createdAt nostr.Timestamp) *nostr.Event {
+		return signed(t, authorKey, nostr.Event{Kind: nostr.KindProfileMetadata, CreatedAt: createdAt})
+	}
+
+	// the relay never stored these events: the deletion arrives first
+	deletion := signed(t, authorKey, nostr.Event{Kind: nostr.KindDeletion, CreatedAt: now, Tags: nostr.Tags{
+		{"e", note.ID},
+		{"a", fmt.Sprintf("%d:%s:post", nostr.KindArticle, author)},
+		{"a", fmt.Sprintf("%d:%s:", nostr.KindProfileMetadata, author)},
+	}})
+	s.OverwriteResponseEvent(context.Background(), deletion)
+
+	for _, tt := range []struct {
+		name     string
+		evt      *nostr.Event
+		rejected bool
+	}{
+		{name: "deleted id", evt: note, rejected: true},
+		{name: "other note", evt: signed(t, authorKey, nostr.Event{Kind: nostr.KindTextNote, CreatedAt: now, Content: "kept"}), rejected: false},
+		{name: "deleted address", evt: article(authorKey, now-10), rejected: true},
+		{name: "address at the deletion", evt: article(authorKey, now), rejected: true},
+		{name: "newer version of the address", evt: article(authorKey, now+10), rejected: false},
+		{name: "same address by another author", evt: article(otherKey, now-10), rejected: false},
+		{name: "deleted replaceable", evt: profile(now - 10), rejected: true},
+		{name: "newer replaceable", evt: profile(now + 10), rejected: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if rejected, msg := s.RejectEvent(context.Background(), tt.evt); rejected != tt.rejected {
+				t.Errorf("rejected = %v (%s), want %v", rejected, msg, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestDeletionOfOthersEvents(t *testing.T) {
+	s := newTestStore(t)
+	other, _ := nostr.GetPublicKey(otherKey)
+	note := signed(t, otherKey, nostr.Event{Kind: nostr.KindTextNote, CreatedAt: nostr.Now() - 100})
+	article := signed(t, otherKey, nostr.Event{Kind: nostr.KindArticle, CreatedAt: nostr.Now() - 100, Tags: nostr.Tags{{"d", "post"}}})
+
+	// a deletion may only remove its author's events
+	deletion := signed(t, authorKey, nostr.Event{Kind: nostr.KindDeletion, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"e", note.ID},
+		{"a", fmt.Sprintf("%d:%s:post", nostr.KindArticle, other)},
+	}})
+	if err := s.RecordDeletion(deletion); err != nil {
+		t.Fatal(err)
+	}
+	for _, evt := range []*nostr.Event{note, article} {
+		if rejected, msg := s.RejectEvent(context.Background(), evt); rejected {
+			t.Errorf("kind %d of another author rejected: %s", evt.Kind, msg)
+		}
+	}
+
+	// a moderator's deletion, accepted by the relay, tombstones the target itself
+	decide := func(context.Context, *nostr.Event, *nostr.Event) (bool, string) { return true, "" }
+	s.OverwriteDeletionOutcome(decide)(context.Background(), article, deletion)
+	if rejected, _ := s.RejectEvent(context.Background(), article); !rejected {
+		t.Error("event deleted by an accepted deletion was not rejected")
+	}
+}
@@ -0,0 +1,195 @@
+// Package vanish implements NIP-62 requests to vanish: a pubkey asking this relay (or every
+// relay) to forget it gets its events, blobs and membership records erased, and events it
+// signed before the request can never be stored again.
+package vanish
+
+import (
+	"SimpleNosrtRelay/infra/log"
+	"SimpleNosrtRelay/infra/manager"
+	"SimpleNosrtRelay/infra/nip05"
+	"context"
+	"encoding/json"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"go.uber.org/zap"
+)
+
+// KindRequestToVanish is the NIP-62 request to vanish.
+const KindRequestToVanish = 62
+
+// AllRelays is the relay tag value addressing every relay.
+const AllRelays = "ALL_RELAYS"
+
+// Request is the record kept for a pubkey that vanished.
+type Request struct {
+	RequestID string          `json:"request_id"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+// Vanisher erases pubkeys that requested to vanish.
+type Vanisher struct {
+	db    *badger.DB
+	store eventstore.Store
+	m     *manager.Manager
+
+	// DeleteEvent is called for every erased event, so every backend forgets it.
+	DeleteEvent []func(ctx context.Context, evt *nostr.Event) error
+	// Blobs tracks blob ownership; when set, blobs left without owners are removed with DeleteBlob.
+	Blobs      blossom.BlobIndex
+	DeleteBlob []func(ctx context.Context, sha256 string) error
+}
+
+// New creates a Vanisher finding events in store and membership records in m.
+func New(db *badger.DB, store eventstore.Store, m *manager.Manager) *Vanisher {
+	return &Vanisher{db: db, store: store, m: m}
+}
+
+// TargetsThisRelay reports whether the request to vanish addresses this relay.
+func TargetsThisRelay(evt *nostr.Event) bool {
+	self := nip05.RelayURL()
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || tag[0] != "relay" {
+			continue
+		}
+		if tag[1] == AllRelays || nostr.NormalizeURL(tag[1]) == self {
+			return true
+		}
+	}
+	return false
+}
+
+// RejectEvent refuses requests to vanish aimed at other relays and events signed by a
+// vanished pubkey before its request.
+func (v *Vanisher) RejectEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	if evt.Kind == KindRequestToVanish && !TargetsThisRelay(evt) {
+		return true, "invalid: request to vanish does not target this relay"
+	}
+	if req, err := v.query(evt.PubKey); err == nil && evt.CreatedAt <= req.CreatedAt {
+		return true, "blocked: this pubkey requested to vanish"
+	}
+	return false, ""
+}
+
+// SaveEvent erases the author of a request to vanish. It is meant for the StoreEvent hook,
+// after the event store, so the request itself is kept and cannot be rebroadcast here.
+func (v *Vanisher) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if evt.Kind != KindRequestToVanish || !TargetsThisRelay(evt) {
+		return nil
+	}
+	// the erasure must complete even if the requesting client disconnects
+	return v.Vanish(context.WithoutCancel(ctx), evt)
+}
+
+// Vanish records req and erases everything its author published up to its created_at.
+func (v *Vanisher) Vanish(ctx context.Context, req *nostr.Event) error {
+	if err := v.save(req); err != nil {
+		return err
+	}
+	log.Logger.Info("Pubkey requested to vanish", zap.String("pubkey", req.PubKey), zap.String("ID", req.ID))
+
+	if err := v.deleteBlobs(ctx, req.PubKey); err != nil {
+		return err
+	}
+
+	// a negentropy session lifts the store's query limit so every event is visited
+	ctx = eventstore.SetNegentropy(ctx)
+	filters := []nostr.Filter{
+		{Authors: []string{req.PubKey}, Until: &req.CreatedAt},
+		// gift wraps addressed to the pubkey carry its DMs too
+		{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": []string{req.PubKey}}, Until: &req.CreatedAt},
+	}
+	count := 0
+	for _, filter := range filters {
+		ch, err := v.store.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+		var events []*nostr.Event
+		for evt := range ch {
+			if evt.Kind != KindRequestToVanish {
+				events = append(events, evt)
+			}
+		}
+		for _, evt := range events {
+			for _, del := range v.DeleteEvent {
+				if err := del(ctx, evt); err != nil {
+					log.Logger.Error("Failed to delete event", zap.String("ID", evt.ID), zap.Error(err))
+				}
+			}
+		}
+		count += len(events)
+	}
+	log.Logger.Info("Erased vanished pubkey", zap.String("pubkey", req.PubKey), zap.Int("events", count))
+
+	return v.m.Forget(req.PubKey)
+}
+
+// Vanished reports whether pubkey requested to vanish from this relay.
+func (v *Vanisher) Vanished(pubkey string) bool {
+	_, err := v.query(pubkey)
+	return err == nil
+}
+
+// deleteBlobs drops pubkey's ownership of its blobs and removes the ones nobody else owns.
+func (v *Vanisher) deleteBlobs(ctx context.Context, pubkey string) error {
+	if v.Blobs == nil {
+		return nil
+	}
+	ch, err := v.Blobs.List(eventstore.SetNegentropy(ctx), pubkey)
+	if err != nil {
+		return err
+	}
+	var hashes []string
+	for bd := range ch {
+		hashes = append(hashes, bd.SHA256)
+	}
+
+	for _, sha256 := range hashes {
+		if err := v.Blobs.Delete(ctx, sha256, pubkey); err != nil {
+			return err
+		}
+		if owner, err := v.Blobs.Get(ctx, sha256); err != nil || owner != nil {
+			continue
+		}
+		for _, del := range v.DeleteBlob {
+			if err := del(ctx, sha256); err != nil {
+				log.Logger.Error("Failed to delete blob", zap.String("sha256", sha256), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// save records req, keeping the most recent request of its author.
+func (v *Vanisher) save(req *nostr.Event) error {
+	if current, err := v.query(req.PubKey); err == nil && current.CreatedAt >= req.CreatedAt {
+		return nil
+	}
+	return v.db.Update(func(txn *badger.Txn) error {
+		jdata, err := json.Marshal(Request{RequestID: req.ID, CreatedAt: req.CreatedAt})
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte("vanish:"+req.PubKey), jdata)
+	})
+}
+
+func (v *Vanisher) query(pubkey string) (*Request, error) {
+	req := &Request{}
+	err := v.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("vanish:" + pubkey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, req)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}